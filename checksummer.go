@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 )
 
 // VERSION sets the version
@@ -18,16 +20,94 @@ type File struct {
 	Checksum string
 }
 
+// Command is an action that can be run from the command line
+type Command struct {
+	Usage string
+	Run   func(db *DB, args []string) error
+}
+
+var commands = map[string]Command{
+	"repair":      {"[-n] [-suffix .restored] BACKUP_ROOT_OR_DB...", cmdRepair},
+	"parity":      {"[-r PERCENT] FILE_OR_FOLDER...", cmdParity},
+	"reconstruct": {"[-n]", cmdReconstruct},
+	"index":       {"[-drop]", cmdIndex},
+	"search": {"[-format FORMAT] QUERY", listCommand("search", func(db *DB, args []string) error {
+		return db.Search(strings.Join(args, " "))
+	})},
+	"rank": {"[-format FORMAT]", listCommand("rank", func(db *DB, args []string) error {
+		return db.RankFilesize()
+	})},
+	"modified": {"[-format FORMAT]", listCommand("modified", func(db *DB, args []string) error {
+		return db.RankModified()
+	})},
+	"duplicates": {"[-format FORMAT] [-sort wasted|count|path] [-dir DIR] [-fast]", cmdDuplicates},
+	"dedupe":     {"-action hardlink|reflink|symlink|delete [-keep oldest|newest|shortest] [-prefer DIR] [-dir DIR] [-n]", cmdDedupe},
+	"du":         {"[-format FORMAT] [-depth N] [-i] [DIR]", cmdDiskUsage},
+	"dupdirs":    {"[-format FORMAT] [-similar PERCENT]", cmdDuplicateDirectories},
+	"snapshot":   {"[-list] [-delete] NAME", cmdSnapshot},
+	"diff":       {"[-format FORMAT] SNAPSHOT [SNAPSHOT]", cmdDiff},
+	"metrics":    {"[-listen ADDRESS | -textfile FILE] [OTHER.db...]", cmdMetrics},
+	"daemon":     {"[-list] [-set NAME=VALUE]", cmdDaemon},
+	"watch":      {"[-settle 10s] [-rescan 1h]", cmdWatch},
+	"db":         {"check [-full] | backup | -list | -set NAME=VALUE", cmdDatabase},
+	"manifest":   {"[-update] [-list] [-keygen FILE] [-pubkey FILE]", cmdManifest},
+	"notify":     {"[-list] [-set NAME=VALUE] [-test]", cmdNotify},
+	"xattr":      {"write | import | check | verify [PATH...] | -list | -set NAME=VALUE", cmdXattr},
+	"serve":      {"[-listen ADDRESS] [-token TOKEN]", cmdServe},
+	"stats":      {"[-format text|json] [-days N]", cmdStats},
+	"deleted": {"[-format FORMAT]", listCommand("deleted", func(db *DB, args []string) error {
+		return db.ShowDeleted()
+	})},
+	"changed": {"[-format FORMAT]", listCommand("changed", func(db *DB, args []string) error {
+		return db.ShowChanged()
+	})},
+	"which": {"[-format FORMAT] FILE...", listCommand("which", func(db *DB, args []string) error {
+		return db.Which(args)
+	})},
+	"lookup": {"[-format FORMAT] CHECKSUM...", listCommand("lookup", func(db *DB, args []string) error {
+		return db.Lookup(args)
+	})},
+}
+
 func main() {
+	format := flag.String("format", "text", "output format of listings: "+strings.Join(outputFormats, ", "))
+	verifyXattrs := flag.Bool("verify-xattrs", false, "verify files and folders against the checksums in their extended attributes, without a database")
 	flag.Parse()
+	err := setFormat(*format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *verifyXattrs && flag.NArg() > 0 {
+		err = VerifySidecars(flag.Args())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	database := flag.Arg(0)
 	if database == "" {
 		fmt.Println("Checksummer version", VERSION)
 		fmt.Println("")
-		fmt.Println("Usage:   ./checksummer sqlite3.db [search arguments]")
+		fmt.Println("Usage:   ./checksummer [-format FORMAT] sqlite3.db [--] [search arguments]")
+		fmt.Println("         ./checksummer [-format FORMAT] sqlite3.db command [arguments]")
+		fmt.Println("         ./checksummer -verify-xattrs FILE_OR_FOLDER...")
 		fmt.Println("")
 		fmt.Println("Example: ./checksummer myfiles.db")
 		fmt.Println("")
+		fmt.Println("Commands:")
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("  %s %s\n", name, commands[name].Usage)
+		}
+		fmt.Println("")
 		os.Exit(1)
 	}
 
@@ -42,8 +122,34 @@ func main() {
 	}
 
 	term := flag.Arg(1)
+	if term == "--" && flag.NArg() > 2 {
+		// search for words that are also command names
+		err = db.Search(strings.Join(flag.Args()[2:], " "))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if cmd, ok := commands[term]; ok {
+		run := func() error { return cmd.Run(db, flag.Args()[2:]) }
+		if writeCommands[term] {
+			err = db.withLock(term, run)
+		} else {
+			err = run()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	if term != "" {
-		db.Search(term)
+		err = db.Search(strings.Join(flag.Args()[1:], " "))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}
 
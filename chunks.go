@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// Chunk holds the checksum of a fixed-size part of a file
+type Chunk struct {
+	FileID   int64
+	Index    int64
+	Size     int64
+	Checksum string
+}
+
+// Offset returns the position of the first byte of the chunk
+func (c Chunk) Offset() int64 {
+	return c.Index * c.Size
+}
+
+// GetChunksize returns the configured chunk size in bytes, 0 means disabled
+func (db *DB) GetChunksize() int64 {
+	val, err := db.GetOption("chunksize")
+	if err != nil {
+		return 0
+	}
+	chunksize, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || chunksize < 0 {
+		return 0
+	}
+	return chunksize
+}
+
+// ChangeChunksize sets the size of the chunks hashed by MakeChecksums
+func (db *DB) ChangeChunksize() error {
+	fmt.Println("Choose chunk size for block-level checksums")
+	val := readLine("enter size in MiB (0 disables): ")
+	mib, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || mib < 0 {
+		fmt.Println("invalid size:", val)
+		return err
+	}
+	return db.SetOption("chunksize", strconv.FormatInt(mib<<20, 10))
+}
+
+// HashFileChunks takes a path and a chunk size and returns the hash of the
+// whole file together with the hash of every chunk
+func HashFileChunks(path string, chunksize int64) (hash string, chunks []string, err error) {
+	return hashFileChunks(path, chunksize, ioutil.Discard)
+}
+
+// hashFileChunks is HashFileChunks reporting the bytes read to progress
+func hashFileChunks(path string, chunksize int64, progress io.Writer) (hash string, chunks []string, err error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("File not found: %s", path)
+		return "", nil, err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	for {
+		chunkHasher := sha256.New()
+		n, err := io.CopyN(io.MultiWriter(hasher, chunkHasher, progress), file, chunksize)
+		if n > 0 {
+			chunks = append(chunks, hex.EncodeToString(chunkHasher.Sum(nil)))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	hash = hex.EncodeToString(hasher.Sum(nil))
+
+	return hash, chunks, nil
+}
+
+// saveChunks replaces the stored chunk checksums of a file
+func saveChunks(tx *sql.Tx, fileID int64, chunksize int64, chunks []string) error {
+	_, err := tx.Exec("DELETE FROM chunks WHERE file_id = ?", fileID)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO chunks(file_id, chunk, chunksize, checksum_sha256) VALUES(?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i, checksum := range chunks {
+		_, err = stmt.Exec(fileID, i, chunksize, checksum)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadChunks returns the stored chunk checksums of a file, ordered by position
+func loadChunks(tx *sql.Tx, fileID int64) ([]Chunk, error) {
+	rows, err := tx.Query(`SELECT chunk, chunksize, checksum_sha256
+                            FROM chunks
+                            WHERE file_id = ?
+                            ORDER BY chunk`, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chunks []Chunk
+	for rows.Next() {
+		c := Chunk{FileID: fileID}
+		err = rows.Scan(&c.Index, &c.Size, &c.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks, rows.Err()
+}
+
+// verifyChunks hashes the file at path and compares it with the stored
+// checksums. If chunk checksums are stored for the file, the chunks that
+// differ are flagged in the database and returned.
+func verifyChunks(tx *sql.Tx, file File, path string, progress io.Writer) (hash string, damaged []Chunk, err error) {
+	stored, err := loadChunks(tx, file.ID)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(stored) == 0 {
+		hash, err = hashFile(path, progress)
+		return hash, nil, err
+	}
+
+	chunksize := stored[0].Size
+	hash, chunks, err := hashFileChunks(path, chunksize, progress)
+	if err != nil {
+		return "", nil, err
+	}
+
+	stmt, err := tx.Prepare("UPDATE chunks SET chunk_ok = ? WHERE file_id = ? AND chunk = ?")
+	if err != nil {
+		return "", nil, err
+	}
+	defer stmt.Close()
+
+	for _, c := range stored {
+		ok := c.Index < int64(len(chunks)) && chunks[c.Index] == c.Checksum
+		if !ok {
+			damaged = append(damaged, c)
+		}
+		_, err = stmt.Exec(ok, file.ID, c.Index)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	// the file grew: everything behind the last stored chunk differs
+	for i := int64(len(stored)); i < int64(len(chunks)); i++ {
+		damaged = append(damaged, Chunk{FileID: file.ID, Index: i, Size: chunksize, Checksum: chunks[i]})
+	}
+
+	return hash, damaged, nil
+}
+
+// damagedChunks returns the chunks flagged by ReindexCheck, grouped by file id
+func (db *DB) damagedChunks() (map[int64][]Chunk, error) {
+	rows, err := db.Query(`SELECT file_id, chunk, chunksize, checksum_sha256
+                            FROM chunks
+                            WHERE chunk_ok = 0
+                            ORDER BY file_id, chunk`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	damaged := make(map[int64][]Chunk)
+	for rows.Next() {
+		var c Chunk
+		err = rows.Scan(&c.FileID, &c.Index, &c.Size, &c.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		damaged[c.FileID] = append(damaged[c.FileID], c)
+	}
+	return damaged, rows.Err()
+}
+
+// formatRanges merges adjacent chunks and formats them as byte ranges
+func formatRanges(chunks []Chunk, filesize int64) []string {
+	var ranges []string
+	for i := 0; i < len(chunks); i++ {
+		start := chunks[i].Offset()
+		end := start + chunks[i].Size
+		for i+1 < len(chunks) && chunks[i+1].Offset() == end {
+			i++
+			end += chunks[i].Size
+		}
+		if filesize > start && end > filesize {
+			end = filesize
+		}
+		ranges = append(ranges, fmt.Sprintf("bytes %v-%v (%v)", start, end-1, ByteSize(end-start)))
+	}
+	return ranges
+}
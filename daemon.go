@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// daemonTick is how often the daemon looks for due jobs
+	daemonTick = time.Minute
+	// daemonRetry is how long the daemon waits before retrying a failed job
+	daemonRetry = 10 * time.Minute
+	// defaultVerifyBudget is how many bytes a rolling verify reads if no budget is set
+	defaultVerifyBudget = 10 << 30
+)
+
+// daemonJobs are the scheduled jobs, in the order they are run when due at once
+var daemonJobs = []struct {
+	name string
+	help string
+	run  func(db *DB, resume bool)
+}{
+	{"collect", "collect new files and make their checksums", func(db *DB, resume bool) {
+		db.CollectFiles()
+		db.CheckFilesDB()
+		db.MakeChecksums()
+	}},
+	{"full", "reindex & check all files", func(db *DB, resume bool) {
+		db.ReindexCheck(resume)
+	}},
+	{"verify", "check the files verified longest ago, up to verify_budget bytes", func(db *DB, resume bool) {
+		budget, err := parseSize(db.daemonOption("verify_budget"))
+		if err != nil {
+			budget = defaultVerifyBudget
+		}
+		db.RollingVerify(budget)
+	}},
+}
+
+// daemonOptions are the settings of the daemon, stored as options prefixed with daemon_
+var daemonOptions = []struct {
+	name string
+	help string
+}{
+	{"collect", "interval of collect, e.g. 1h, 0 or empty to disable"},
+	{"verify", "interval of the rolling verify, e.g. 24h"},
+	{"verify_budget", "bytes read by one rolling verify (default 10G)"},
+	{"full", "interval of the full reindex & check, e.g. 30d"},
+	{"hours", "hours verify and full may start in, e.g. 1-6 (default any time)"},
+}
+
+// daemonOption returns a daemon setting, empty if not set
+func (db *DB) daemonOption(name string) string {
+	return db.optionalOption("daemon_" + name)
+}
+
+// parseInterval parses durations like 90m, 1h, 7d or 4w
+func parseInterval(s string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for suffix, unit := range units {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid interval %q", s)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	if s == "0" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// inHours reports whether the hour lies in a window like 1-6 or 22-4
+func inHours(window string, hour int) bool {
+	if window == "" {
+		return true
+	}
+	var from, to int
+	_, err := fmt.Sscanf(window, "%d-%d", &from, &to)
+	if err != nil {
+		return true
+	}
+	if from <= to {
+		return hour >= from && hour <= to
+	}
+	return hour >= from || hour <= to
+}
+
+// RollingVerify checks the files verified longest ago, or never, until
+// budget bytes are read. Every block is committed, so an interrupted run
+// loses nothing and the next one continues with the files not yet done.
+func (db *DB) RollingVerify(budget int64) {
+
+	// get basepath
+	basepath, err := db.GetOption("basepath")
+	checkErr(err)
+
+	var files []File
+	var total int64
+	rows, err := db.Query(`SELECT id, filename, filesize, checksum_sha256
+                           FROM files
+                           WHERE file_found = '1'
+                           AND checksum_sha256 IS NOT NULL
+                           ORDER BY checked IS NOT NULL, checked, id`)
+	checkErr(err)
+	for rows.Next() && total < budget {
+		var file File
+		var filesize sql.NullInt64
+		checkErr(rows.Scan(&file.ID, &file.Name, &filesize, &file.Checksum))
+		file.Size = filesize.Int64
+		files = append(files, file)
+		total += file.Size
+	}
+	rows.Close()
+
+	progress := NewProgress("verifying checksums", len(files), total)
+	readErrors := 0
+	for len(files) > 0 {
+		block := files
+		if len(block) > 100 {
+			block = block[:100]
+		}
+		files = files[len(block):]
+
+		readErrors += db.checkFiles(basepath, block, progress)
+	}
+	progress.Finish()
+
+	checkErr(db.SetOption("last_verify_read_errors", strconv.Itoa(readErrors)))
+
+	// see notify.go
+	err = db.Notify(false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// daemonLock is kept open while the daemon runs, closing it releases the lock
+var daemonLock *os.File
+
+// lockDaemon makes sure only one daemon runs on a database. The lock is
+// released by the kernel when the process exits.
+func (db *DB) lockDaemon() error {
+	f, err := db.flock(".daemon.lock")
+	if err == errLocked {
+		return fmt.Errorf("another daemon is running on this database")
+	}
+	daemonLock = f
+	return err
+}
+
+// runDaemonJob runs a job and records when it finished; the operations
+// panic on errors like the rest of checksummer
+func (db *DB) runDaemonJob(name string, run func(db *DB, resume bool), resume bool) (err error) {
+	err = db.Lock("daemon " + name)
+	if err != nil {
+		log.Printf("%v postponed: %v", name, err)
+		return err
+	}
+
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+			log.Printf("%v failed after %v: %v", name, time.Since(start).Round(time.Second), err)
+
+			// start over next time
+			db.SetOption("daemon_checkpoint", "")
+		}
+	}()
+
+	return db.finishRun(func() error {
+		log.Printf("%v started", name)
+		checkErr(db.SetOption("daemon_checkpoint", name))
+
+		run(db, resume)
+
+		checkErr(db.SetOption("daemon_checkpoint", ""))
+		checkErr(db.SetOption("daemon_last_"+name, strconv.FormatInt(time.Now().Unix(), 10)))
+		if name == "full" {
+			// a full check includes the rolling verify
+			checkErr(db.SetOption("daemon_last_verify", strconv.FormatInt(time.Now().Unix(), 10)))
+		}
+		s, err := db.GetSummary()
+		checkErr(err)
+		log.Printf("%v finished in %v: %v files, %v changed, %v missing, %v read errors", name,
+			time.Since(start).Round(time.Second), s.Files, s.Changed, s.MissingTotal, s.ReadErrors)
+		return nil
+	})
+}
+
+// Daemon runs the scheduled jobs one after another until the process is
+// stopped. A job interrupted by a restart is resumed first.
+func (db *DB) Daemon() error {
+	err := db.lockDaemon()
+	if err != nil {
+		return err
+	}
+	log.SetOutput(os.Stdout)
+	log.Printf("daemon started")
+
+	retry := map[string]time.Time{}
+	for {
+		now := time.Now()
+		if name := db.daemonOption("checkpoint"); name != "" && !now.Before(retry[name]) {
+			for _, job := range daemonJobs {
+				if job.name == name {
+					log.Printf("resuming interrupted %v", name)
+					if db.runDaemonJob(job.name, job.run, true) != nil {
+						retry[job.name] = time.Now().Add(daemonRetry)
+					}
+				}
+			}
+		}
+
+		for _, job := range daemonJobs {
+			interval, err := parseInterval(db.daemonOption(job.name))
+			if err != nil || interval <= 0 || now.Before(retry[job.name]) {
+				continue
+			}
+			if job.name != "collect" && !inHours(db.daemonOption("hours"), now.Hour()) {
+				continue
+			}
+			last, _ := strconv.ParseInt(db.daemonOption("last_"+job.name), 10, 64)
+			if now.Sub(time.Unix(last, 0)) < interval {
+				continue
+			}
+			if db.runDaemonJob(job.name, job.run, false) != nil {
+				retry[job.name] = time.Now().Add(daemonRetry)
+			}
+		}
+
+		time.Sleep(daemonTick)
+	}
+}
+
+func cmdDaemon(db *DB, args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	list := flags.Bool("list", false, "show the schedule and the last runs")
+	set := flags.String("set", "", "change a setting, e.g. verify=24h; an empty value disables it")
+	flags.Parse(args)
+
+	switch {
+	case *list:
+		for _, o := range daemonOptions {
+			fmt.Printf("%-14v %-10v %v\n", o.name, db.daemonOption(o.name), o.help)
+		}
+		fmt.Println("")
+		for _, job := range daemonJobs {
+			last := "never"
+			if t, err := strconv.ParseInt(db.daemonOption("last_"+job.name), 10, 64); err == nil && t > 0 {
+				last = time.Unix(t, 0).Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%-14v last run %-20v %v\n", job.name, last, job.help)
+		}
+		if name := db.daemonOption("checkpoint"); name != "" {
+			fmt.Printf("\n%v was interrupted and will be resumed\n", name)
+		}
+		return nil
+	case *set != "":
+		parts := strings.SplitN(*set, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("use -set NAME=VALUE")
+		}
+		for _, o := range daemonOptions {
+			if o.name != parts[0] {
+				continue
+			}
+			var err error
+			switch {
+			case parts[1] == "":
+			case o.name == "verify_budget":
+				_, err = parseSize(parts[1])
+			case o.name == "hours":
+				if !strings.Contains(parts[1], "-") {
+					err = fmt.Errorf("use hours like 1-6")
+				}
+			default:
+				_, err = parseInterval(parts[1])
+			}
+			if err != nil {
+				return err
+			}
+			return db.SetOption("daemon_"+parts[0], parts[1])
+		}
+		return fmt.Errorf("unknown setting %q, see daemon -list", parts[0])
+	}
+	return db.Daemon()
+}
@@ -1,51 +1,79 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // DB wraps sql.DB
 type DB struct {
 	*sql.DB
+	lockMutex    sync.Mutex
+	lockFile     *os.File // see lock.go
+	lockCount    int
+	lockRecorded bool      // the manifest was written during the lock
+	lockConn     *sql.Conn // watches for commits during the lock, see maintenance.go
+	lockVersion  int64
 }
 
 // Open returns a DB reference for a data source.
 func Open(dataSourceName string) (*DB, error) {
-	db, err := sql.Open("sqlite3", dataSourceName)
+	// wait for other connections writing instead of failing right away
+	if !strings.Contains(dataSourceName, "?") {
+		dataSourceName += fmt.Sprintf("?_busy_timeout=%d", busyTimeout/time.Millisecond)
+	}
+	// see maintenance.go for the settings of each connection
+	db, err := sql.Open("checksummer", dataSourceName)
 	if err != nil {
 		return nil, err
 	}
-	return &DB{db}, nil
+	return &DB{DB: db}, nil
 }
 
 // Init initializes the database
 func (db *DB) Init() error {
-	_, err := db.Exec(`CREATE TABLE files (
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS files (
                         id INTEGER PRIMARY KEY AUTOINCREMENT,
                         filename TEXT UNIQUE,
                         checksum_sha256 TEXT,
                         filesize INTEGER,
                         mtime INTEGER,
                         file_found INTEGER,
-                        checksum_ok INTEGER
+                        checksum_ok INTEGER,
+                        checked INTEGER
                         )`)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec(`CREATE TABLE options (
+	// databases created before checked was added
+	err = db.addColumn("files", "checked", "INTEGER")
+	if err != nil {
+		return err
+	}
+
+	// lookups by content and size
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS files_checksum ON files (checksum_sha256)")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS files_filesize ON files (filesize)")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS options (
                         id integer primary key autoincrement,
                         o_name text unique,
                         o_value text
@@ -54,22 +82,174 @@ func (db *DB) Init() error {
 		return err
 	}
 
-	// tuning
-	_, err = db.Exec("PRAGMA synchronous=OFF")
-	checkErr(err)
-	_, err = db.Exec("PRAGMA journal_size_limit=-1")
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS chunks (
+                        file_id INTEGER,
+                        chunk INTEGER,
+                        chunksize INTEGER,
+                        checksum_sha256 TEXT,
+                        chunk_ok INTEGER,
+                        PRIMARY KEY (file_id, chunk)
+                        )`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS parity_files (
+                        file_id INTEGER PRIMARY KEY,
+                        filesize INTEGER,
+                        shardsize INTEGER,
+                        redundancy INTEGER
+                        )`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS parity_shards (
+                        file_id INTEGER,
+                        stripe INTEGER,
+                        shard INTEGER,
+                        checksum_sha256 TEXT,
+                        data BLOB,
+                        PRIMARY KEY (file_id, stripe, shard)
+                        )`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS snapshots (
+                        id INTEGER PRIMARY KEY AUTOINCREMENT,
+                        name TEXT UNIQUE,
+                        created INTEGER
+                        )`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS snapshot_files (
+                        snapshot_id INTEGER,
+                        filename TEXT,
+                        filesize INTEGER,
+                        mtime INTEGER,
+                        checksum_sha256 TEXT,
+                        removed INTEGER NOT NULL DEFAULT 0,
+                        PRIMARY KEY (snapshot_id, filename)
+                        ) WITHOUT ROWID`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS snapshot_files_filename ON snapshot_files (filename, snapshot_id)")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS manifests (
+                        id INTEGER PRIMARY KEY AUTOINCREMENT,
+                        created INTEGER,
+                        files INTEGER,
+                        root TEXT,
+                        previous TEXT,
+                        digest TEXT,
+                        public_key TEXT,
+                        signature TEXT
+                        )`)
+	if err != nil {
+		return err
+	}
+
+	// the directory roots of the latest manifest, and the directories changed
+	// since, see manifest.go
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS manifest_dirs (
+                        dir TEXT PRIMARY KEY,
+                        files INTEGER,
+                        root TEXT
+                        ) WITHOUT ROWID`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS manifest_dirty (
+                        dir TEXT PRIMARY KEY
+                        ) WITHOUT ROWID`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS files_dir ON files (" + dirOf("filename") + ", filename)")
+	if err != nil {
+		return err
+	}
+	for _, statement := range []string{
+		`CREATE TRIGGER IF NOT EXISTS files_manifest_insert AFTER INSERT ON files
+                        WHEN new.checksum_sha256 IS NOT NULL BEGIN
+                        INSERT OR IGNORE INTO manifest_dirty(dir) VALUES (` + dirOf("new.filename") + `);
+                        END`,
+		`CREATE TRIGGER IF NOT EXISTS files_manifest_delete AFTER DELETE ON files
+                        WHEN old.checksum_sha256 IS NOT NULL BEGIN
+                        INSERT OR IGNORE INTO manifest_dirty(dir) VALUES (` + dirOf("old.filename") + `);
+                        END`,
+		`CREATE TRIGGER IF NOT EXISTS files_manifest_update AFTER UPDATE OF filename, filesize, checksum_sha256 ON files
+                        WHEN old.filename IS NOT new.filename
+                        OR old.filesize IS NOT new.filesize
+                        OR old.checksum_sha256 IS NOT new.checksum_sha256 BEGIN
+                        INSERT OR IGNORE INTO manifest_dirty(dir) VALUES (` + dirOf("old.filename") + `);
+                        INSERT OR IGNORE INTO manifest_dirty(dir) VALUES (` + dirOf("new.filename") + `);
+                        END`,
+	} {
+		_, err = db.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the missing files of the last notification, see notify.go
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS notified_missing (
+                        file_id INTEGER PRIMARY KEY
+                        )`)
+	if err != nil {
+		return err
+	}
+
+	// with the write-ahead log, reading commands run while a check is writing;
+	// the durability mode is applied per connection, see maintenance.go
+	_, err = db.Exec("PRAGMA journal_mode=WAL")
 	checkErr(err)
 
 	return nil
 }
 
+// addColumn adds a column to an existing table unless it is already there
+func (db *DB) addColumn(table string, column string, definition string) error {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			ctype      string
+			notnull    int
+			dflt       sql.NullString
+			primarykey int
+		)
+		err = rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &primarykey)
+		if err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	rows.Close()
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
 // ChangeBasepath sets the basepath
 func (db *DB) ChangeBasepath() error {
-	reader := bufio.NewReader(os.Stdin)
 	fmt.Println("Choose base path")
-	fmt.Print("enter full path: ")
-	basepath, _ := reader.ReadString('\n')
-	basepath = strings.Trim(basepath, "\n")
+	basepath := readLine("enter full path: ")
 	basepath = strings.TrimRight(basepath, "/")
 	err := db.SetOption("basepath", basepath)
 	return err
@@ -131,6 +311,9 @@ func (db *DB) CollectFiles() {
 
 	tx, err = db.Begin()
 	checkErr(err)
+	// on a panic, the open transaction must not keep the database locked;
+	// tx is reopened below, the rollback of a committed one does nothing
+	defer func() { tx.Rollback() }()
 
 	// Precompile SQL statement
 	insertStatement := "INSERT INTO files(filename, filesize, mtime, file_found) VALUES(?, ?, ?, 1)"
@@ -213,7 +396,6 @@ func (db *DB) CheckFilesDB() {
 		var files []File
 
 		rows, err := db.Query("SELECT id, filename FROM files LIMIT ?, 10000", i)
-		defer rows.Close()
 		checkErr(err)
 
 		for rows.Next() {
@@ -224,40 +406,47 @@ func (db *DB) CheckFilesDB() {
 		}
 		rows.Close()
 
-		tx, err := db.Begin()
-		checkErr(err)
+		db.statFiles(basepath, files)
+	}
 
-		// prepare update statement
-		stmt, err := tx.Prepare("UPDATE files SET filesize = ?, mtime = ?, file_found = ? WHERE id = ?")
-		checkErr(err)
-		stmtNotFound, err := tx.Prepare("UPDATE files SET file_found = 0 WHERE id = ?")
-		checkErr(err)
+	return
+}
 
-		for _, file := range files {
-			path := basepath + file.Name
-
-			f, err := os.Open(path)
-			if err != nil {
-				// file not found
-				_, err = stmtNotFound.Exec(file.ID)
-				checkErr(err)
-			} else {
-				fi, err := f.Stat()
-				file.Size = fi.Size()
-				file.Mtime = fi.ModTime().Unix()
-				_, err = stmt.Exec(file.Size, file.Mtime, 1, file.ID)
-				checkErr(err)
-			}
-			f.Close()
-		}
+// statFiles updates size, mtime and presence of a block of files in one
+// transaction
+func (db *DB) statFiles(basepath string, files []File) {
+	tx, err := db.Begin()
+	checkErr(err)
+	defer tx.Rollback()
 
-		err = stmt.Close()
-		checkErr(err)
-		err = tx.Commit()
-		checkErr(err)
+	// prepare update statement
+	stmt, err := tx.Prepare("UPDATE files SET filesize = ?, mtime = ?, file_found = ? WHERE id = ?")
+	checkErr(err)
+	stmtNotFound, err := tx.Prepare("UPDATE files SET file_found = 0 WHERE id = ?")
+	checkErr(err)
+
+	for _, file := range files {
+		path := basepath + file.Name
+
+		f, err := os.Open(path)
+		if err != nil {
+			// file not found
+			_, err = stmtNotFound.Exec(file.ID)
+			checkErr(err)
+		} else {
+			fi, err := f.Stat()
+			file.Size = fi.Size()
+			file.Mtime = fi.ModTime().Unix()
+			_, err = stmt.Exec(file.Size, file.Mtime, 1, file.ID)
+			checkErr(err)
+		}
+		f.Close()
 	}
 
-	return
+	err = stmt.Close()
+	checkErr(err)
+	err = tx.Commit()
+	checkErr(err)
 }
 
 // MakeChecksums makes checksums of all files
@@ -269,12 +458,17 @@ func (db *DB) MakeChecksums() {
 	basepath, err := db.GetOption("basepath")
 	checkErr(err)
 
+	// block-level checksums, 0 = disabled
+	chunksize := db.GetChunksize()
+
+	// checksums in extended attributes, see xattr.go
+	naming, sidecars := db.sidecars()
+
 	updateStatement := "UPDATE files SET checksum_sha256 = ? WHERE id = ?"
 	notFoundStatement := "UPDATE files SET file_found = 0 WHERE id = ?"
 
 	fileCount, err := db.GetCount("SELECT count(id) FROM files WHERE checksum_sha256 IS NULL AND file_found = '1'")
 	checkErr(err)
-	remaining := fileCount
 
 	ts, err := db.GetCount("SELECT sum(filesize) FROM files WHERE checksum_sha256 IS NULL AND file_found = '1'")
 	if err != nil {
@@ -291,19 +485,17 @@ func (db *DB) MakeChecksums() {
 	bs := 10000.0 / fileSizePerCount * 50000
 	blockSize := int(bs)
 
+	progress := NewProgress("making checksums", fileCount, totalSize)
+
 	// sqlite dies with "unable to open database [14]" when I run two stmts concurrently
 	// therefore, we process by fetching blocks of files
 	for i := fileCount + blockSize; i > 0; i = i - blockSize {
 		var (
-			tx           *sql.Tx
-			stmtUpdate   *sql.Stmt
-			stmtNotFound *sql.Stmt
-			files        []File
-			rows         *sql.Rows
+			files []File
+			rows  *sql.Rows
 		)
 
 		rows, err = db.Query("SELECT id, filename, filesize FROM files WHERE checksum_sha256 IS NULL AND file_found = '1' LIMIT ?", blockSize)
-		defer rows.Close()
 		checkErr(err)
 
 		for rows.Next() {
@@ -315,237 +507,209 @@ func (db *DB) MakeChecksums() {
 		}
 		rows.Close()
 
-		tx, err = db.Begin()
-		checkErr(err)
+		// each block owns its transaction, rolled back if hashing panics
+		func() {
+			tx, err := db.Begin()
+			checkErr(err)
+			defer tx.Rollback()
 
-		// prepare update statement
-		stmtUpdate, err = tx.Prepare(updateStatement)
-		checkErr(err)
-		stmtNotFound, err = tx.Prepare(notFoundStatement)
-		checkErr(err)
+			// prepare update statement
+			stmtUpdate, err := tx.Prepare(updateStatement)
+			checkErr(err)
+			stmtNotFound, err := tx.Prepare(notFoundStatement)
+			checkErr(err)
 
-		for _, file := range files {
-			path := basepath + file.Name
-
-			fmt.Printf("(%s, %s) making checksum: %s (%s)... ", thousandsSeparator(remaining), ByteSize(totalSize), path, ByteSize(file.Size))
-
-			f, err := os.Open(path)
-			if err != nil {
-				// file not found
-				_, err = stmtNotFound.Exec(file.ID)
-				checkErr(err)
-			} else {
-				hash, err := HashFile(path)
-				checkErr(err)
-				_, err = stmtUpdate.Exec(hash, file.ID)
-				checkErr(err)
-			}
-			f.Close()
+			for _, file := range files {
+				path := basepath + file.Name
 
-			fmt.Println("OK")
-			remaining--
-			totalSize = totalSize - file.Size
-		}
+				progress.StartFile(path)
 
-		stmtUpdate.Close()
-		stmtNotFound.Close()
-		fmt.Println("Committing...")
-		err = tx.Commit()
-		checkErr(err)
+				f, err := os.Open(path)
+				if err != nil {
+					// file not found
+					_, err = stmtNotFound.Exec(file.ID)
+					checkErr(err)
+				} else {
+					info, err := f.Stat()
+					checkErr(err)
+					var hash string
+					if chunksize > 0 {
+						var chunks []string
+						hash, chunks, err = hashFileChunks(path, chunksize, progress)
+						checkErr(err)
+						_, err = stmtUpdate.Exec(hash, file.ID)
+						checkErr(err)
+						err = saveChunks(tx, file.ID, chunksize, chunks)
+						checkErr(err)
+					} else {
+						hash, err = hashFile(path, progress)
+						checkErr(err)
+						_, err = stmtUpdate.Exec(hash, file.ID)
+						checkErr(err)
+					}
+					if sidecars {
+						err = writeSidecar(path, naming, hash, info.ModTime(), time.Now())
+						if err != nil {
+							progress.Println("writing extended attributes failed:", path, err)
+						}
+					}
+				}
+				f.Close()
+
+				progress.FinishFile(file.Size)
+			}
+
+			stmtUpdate.Close()
+			stmtNotFound.Close()
+			err = tx.Commit()
+			checkErr(err)
+		}()
 	}
 
-	return
+	progress.Finish()
 }
 
-// Search returns a list of files, ordered by filesize
+// Search returns a list of files matching the query, ordered by filesize
 func (db *DB) Search(term string) error {
+	records, err := db.SearchRecords(term)
+	if err != nil {
+		return err
+	}
+	return writeRecords(records, func(r Record) string {
+		return fmt.Sprintf("%8v    %v\n", ByteSize(r.Size), r.Path)
+	})
+}
+
+// SearchRecords returns the files matching a search expression, largest first
+func (db *DB) SearchRecords(term string) ([]Record, error) {
+	query, err := ParseQuery(term)
+	if err != nil {
+		return nil, err
+	}
 
 	// get basepath
 	basepath, err := db.GetOption("basepath")
 	checkErr(err)
 
-	var buffer bytes.Buffer
-	rows, err := db.Query(`SELECT filename, filesize
-                            FROM files
-                            WHERE filename LIKE ?
-                            ORDER BY filesize DESC`, "%"+term+"%")
-	defer rows.Close()
-	if err == nil {
-		for rows.Next() {
-			var filename string
-			var filesize int64
-			err = rows.Scan(&filename, &filesize)
-			if err != nil {
-				return err
-			}
-			buffer.WriteString(fmt.Sprintf("%8v    %v%v\n", ByteSize(filesize), basepath, filename))
+	where, args := query.Where(db.HasFilenameIndex())
+	found, err := db.queryRecords(`SELECT id, filename, filesize, mtime, checksum_sha256
+                                    FROM files
+                                    WHERE `+where+`
+                                    ORDER BY filesize DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for _, r := range found {
+		if query.Match(strings.TrimPrefix(r.Path, basepath)) {
+			records = append(records, r)
 		}
-		pager(buffer.String())
-		return nil
 	}
-	return err
+	return records, nil
 }
 
 // RankFilesize returns a list of files, ordered by filesize
 func (db *DB) RankFilesize() error {
-
-	// get basepath
-	basepath, err := db.GetOption("basepath")
-	checkErr(err)
-
-	var buffer bytes.Buffer
-	rows, err := db.Query(`SELECT filename, filesize
-                            FROM files
-                            WHERE filesize IS NOT NULL
-                            ORDER BY filesize DESC`)
-	defer rows.Close()
-	if err == nil {
-		for rows.Next() {
-			var filename string
-			var filesize int64
-			err = rows.Scan(&filename, &filesize)
-			if err != nil {
-				return err
-			}
-			buffer.WriteString(fmt.Sprintf("%8v    %v%v\n", ByteSize(filesize), basepath, filename))
-		}
-		pager(buffer.String())
-		return nil
+	records, err := db.queryRecords(`SELECT id, filename, filesize, mtime, checksum_sha256
+                                      FROM files
+                                      WHERE filesize IS NOT NULL
+                                      ORDER BY filesize DESC`)
+	if err != nil {
+		return err
 	}
-	return err
+	return writeRecords(records, func(r Record) string {
+		return fmt.Sprintf("%8v    %v\n", ByteSize(r.Size), r.Path)
+	})
 }
 
 // RankModified returns a list of files, ordered by modified date
 func (db *DB) RankModified() error {
-
-	// get basepath
-	basepath, err := db.GetOption("basepath")
-	checkErr(err)
-
-	var buffer bytes.Buffer
-	rows, err := db.Query(`SELECT filename, filesize, mtime
-                            FROM files
-                            WHERE file_found = '1'
-                            ORDER BY mtime DESC`)
-	defer rows.Close()
-	if err == nil {
-		for rows.Next() {
-			var filename string
-			var filesize int64
-			var date float64 // oddities from a python populated database
-			err = rows.Scan(&filename, &filesize, &date)
-			if err != nil {
-				return err
-			}
-			formattedDate := time.Unix(int64(date), 0).Format("2006-01-02 15:04:05")
-			buffer.WriteString(fmt.Sprintf("%v    %8v    %v%v\n", formattedDate, ByteSize(filesize), basepath, filename))
-		}
-		pager(buffer.String())
-		return nil
-	}
-	return err
-}
-
-// ListDuplicates returns a list of duplicate files, ordered by count
-func (db *DB) ListDuplicates() error {
-
-	// get basepath
-	basepath, err := db.GetOption("basepath")
-	checkErr(err)
-
-	var buffer bytes.Buffer
-	rows, err := db.Query(`SELECT filename, COUNT(checksum_sha256) AS count, SUM(filesize) as totalsize
-                            FROM files
-                            GROUP BY checksum_sha256
-                            HAVING (COUNT(checksum_sha256) > 1)
-                            ORDER BY totalsize DESC`)
-	defer rows.Close()
-	if err == nil {
-		for rows.Next() {
-			var filename string
-			var count int64
-			var filesize int64
-			err = rows.Scan(&filename, &count, &filesize)
-			if err != nil {
-				return err
-			}
-			buffer.WriteString(fmt.Sprintf("%5v    %8v    %v%v\n", count, ByteSize(filesize), basepath, filename))
-		}
-		pager(buffer.String())
-		return nil
+	records, err := db.queryRecords(`SELECT id, filename, filesize, mtime, checksum_sha256
+                                      FROM files
+                                      WHERE file_found = '1'
+                                      ORDER BY mtime DESC`)
+	if err != nil {
+		return err
 	}
-	return err
+	return writeRecords(records, func(r Record) string {
+		formattedDate := time.Unix(r.Mtime, 0).Format("2006-01-02 15:04:05")
+		return fmt.Sprintf("%v    %8v    %v\n", formattedDate, ByteSize(r.Size), r.Path)
+	})
 }
 
 // ShowDeleted returns a list of deleted files, ordered by filesize
 func (db *DB) ShowDeleted() error {
-
-	// get basepath
-	basepath, err := db.GetOption("basepath")
-	checkErr(err)
-
-	var buffer bytes.Buffer
-	rows, err := db.Query(`SELECT filename, filesize, mtime
-                            FROM files
-                            WHERE file_found = '0'
-                            ORDER BY filesize DESC`)
-	defer rows.Close()
-	if err == nil {
-		for rows.Next() {
-			var filename string
-			var filesize int64
-			var date float64 // oddities from a python populated database
-			err = rows.Scan(&filename, &filesize, &date)
-			if err != nil {
-				// ignore, size + date col may be empty when file is not found
-			}
-			formattedDate := time.Unix(int64(date), 0).Format("2006-01-02 15:04:05")
-			buffer.WriteString(fmt.Sprintf("%v    %8v    %v%v\n", formattedDate, ByteSize(filesize), basepath, filename))
-		}
-		pager(buffer.String())
-		return nil
+	records, err := db.DeletedRecords()
+	if err != nil {
+		return err
 	}
-	return err
+	return writeRecords(records, func(r Record) string {
+		formattedDate := time.Unix(r.Mtime, 0).Format("2006-01-02 15:04:05")
+		return fmt.Sprintf("%v    %8v    %v\n", formattedDate, ByteSize(r.Size), r.Path)
+	})
+}
+
+// DeletedRecords returns the deleted files, largest first
+func (db *DB) DeletedRecords() ([]Record, error) {
+	// size + date col may be empty when file is not found
+	return db.queryRecords(`SELECT id, filename, filesize, mtime, checksum_sha256
+                             FROM files
+                             WHERE file_found = '0'
+                             ORDER BY filesize DESC`)
 }
 
 // ShowChanged returns a list of changed files, ordered by filesize
 func (db *DB) ShowChanged() error {
-
-	// get basepath
-	basepath, err := db.GetOption("basepath")
+	damaged, err := db.damagedChunks()
 	checkErr(err)
 
-	var buffer bytes.Buffer
-	rows, err := db.Query(`SELECT filename, filesize
-                            FROM files
-                            WHERE checksum_ok = '0'
-                            ORDER BY filesize DESC`)
-	defer rows.Close()
-	if err == nil {
-		for rows.Next() {
-			var filename string
-			var filesize int64
-			err = rows.Scan(&filename, &filesize)
-			if err != nil {
-				return err
-			}
-			buffer.WriteString(fmt.Sprintf("%8v    %v%v\n", ByteSize(filesize), basepath, filename))
-		}
-		pager(buffer.String())
-		return nil
+	records, err := db.ChangedRecords()
+	if err != nil {
+		return err
 	}
-	return err
+	return writeRecords(records, func(r Record) string {
+		line := fmt.Sprintf("%8v    %v\n", ByteSize(r.Size), r.Path)
+		for _, dr := range formatRanges(damaged[r.ID], r.Size) {
+			line += fmt.Sprintf("%8v    damaged: %v\n", "", dr)
+		}
+		return line
+	})
+}
+
+// ChangedRecords returns the files whose checksum did not match, largest first
+func (db *DB) ChangedRecords() ([]Record, error) {
+	return db.queryRecords(`SELECT id, filename, filesize, mtime, checksum_sha256
+                             FROM files
+                             WHERE checksum_ok = '0'
+                             ORDER BY filesize DESC`)
 }
 
 // PruneDeleted removes deleted files from db
 func (db *DB) PruneDeleted() error {
-	_, err := db.Exec("DELETE FROM files WHERE file_found = '0'")
+	_, err := db.Exec("DELETE FROM chunks WHERE file_id IN (SELECT id FROM files WHERE file_found = '0')")
+	if err != nil {
+		return err
+	}
+	err = db.pruneParity("file_found = '0'")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM files WHERE file_found = '0'")
 	return err
 }
 
 // PruneChanged sets the checksum to NULL for changed files
 func (db *DB) PruneChanged() error {
-	_, err := db.Exec(`UPDATE files
+	_, err := db.Exec("DELETE FROM chunks WHERE file_id IN (SELECT id FROM files WHERE checksum_ok = 0)")
+	if err != nil {
+		return err
+	}
+	err = db.pruneParity("checksum_ok = 0")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE files
                         SET checksum_sha256 = NULL,
                         checksum_ok = NULL,
                         filesize = NULL
@@ -560,9 +724,6 @@ func (db *DB) ReindexCheck(cont bool) {
 	basepath, err := db.GetOption("basepath")
 	checkErr(err)
 
-	updateStatement := "UPDATE files SET checksum_ok = ? WHERE id = ?"
-	notFoundStatement := "UPDATE files SET file_found = 0 WHERE id = ?"
-
 	// continue previous reindex-check session? if not, prepare & start from scratch
 	if cont == false {
 		db.CollectFiles()
@@ -578,7 +739,6 @@ func (db *DB) ReindexCheck(cont bool) {
 
 	fileCount, err := db.GetCount("SELECT count(id) FROM files WHERE checksum_ok IS NULL AND file_found = '1'")
 	checkErr(err)
-	remaining := fileCount
 
 	ts, err := db.GetCount("SELECT sum(filesize) FROM files WHERE checksum_ok IS NULL AND file_found = '1'")
 	checkErr(err)
@@ -593,23 +753,28 @@ func (db *DB) ReindexCheck(cont bool) {
 	bs := 10000.0 / fileSizePerCount * 50000
 	blockSize := int(bs)
 
+	progress := NewProgress("checking checksums", fileCount, totalSize)
+	start := time.Now()
+	readErrors := 0
+
+	// files that could not be read stay unchecked, so walk by id to not fetch them again
+	var lastID int64
+
 	// sqlite dies with "unable to open database [14]" when I run two stmts concurrently
 	// therefore, we process by fetching blocks of files
 	for i := fileCount + blockSize; i > 0; i = i - blockSize {
 		var (
-			tx           *sql.Tx
-			stmtUpdate   *sql.Stmt
-			stmtNotFound *sql.Stmt
-			files        []File
-			rows         *sql.Rows
+			files []File
+			rows  *sql.Rows
 		)
 
 		rows, err = db.Query(`SELECT id, filename, filesize, checksum_sha256
                               FROM files
                               WHERE checksum_ok IS NULL
                               AND file_found = '1'
-                              LIMIT ?`, blockSize)
-		defer rows.Close()
+                              AND id > ?
+                              ORDER BY id
+                              LIMIT ?`, lastID, blockSize)
 		checkErr(err)
 
 		for rows.Next() {
@@ -619,53 +784,84 @@ func (db *DB) ReindexCheck(cont bool) {
 			var checksum string
 			rows.Scan(&id, &filename, &filesize, &checksum)
 			files = append(files, File{ID: id, Name: filename, Size: filesize, Checksum: checksum})
+			lastID = id
 		}
 		rows.Close()
 
-		tx, err = db.Begin()
-		checkErr(err)
+		readErrors += db.checkFiles(basepath, files, progress)
+	}
 
-		// prepare update statement
-		stmtUpdate, err = tx.Prepare(updateStatement)
-		checkErr(err)
-		stmtNotFound, err = tx.Prepare(notFoundStatement)
-		checkErr(err)
+	progress.Finish()
 
-		for _, file := range files {
-			path := basepath + file.Name
-
-			fmt.Printf("(%s, %s) checking checksum: %s (%s)... ", thousandsSeparator(remaining), ByteSize(totalSize), path, ByteSize(file.Size))
-
-			f, err := os.Open(path)
-			if err != nil {
-				// file not found
-				_, err = stmtNotFound.Exec(file.ID)
-				checkErr(err)
-			} else {
-				hash, err := HashFile(path)
-				checkErr(err)
-				if hash == file.Checksum {
-					_, err = stmtUpdate.Exec(1, file.ID)
-					checkErr(err)
-				} else {
-					_, err = stmtUpdate.Exec(0, file.ID)
-					checkErr(err)
-				}
-			}
-			f.Close()
+	// for monitoring, see metrics.go
+	checkErr(db.SetOption("last_verify", strconv.FormatInt(time.Now().Unix(), 10)))
+	checkErr(db.SetOption("last_verify_duration", strconv.FormatFloat(time.Since(start).Seconds(), 'f', 3, 64)))
+	checkErr(db.SetOption("last_verify_read_errors", strconv.Itoa(readErrors)))
+
+	// see notify.go
+	err = db.Notify(false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// checkFiles compares the checksums of a block of files in one transaction
+// and returns the number of files that could not be read
+func (db *DB) checkFiles(basepath string, files []File, progress *Progress) int {
+	tx, err := db.Begin()
+	checkErr(err)
+	defer tx.Rollback()
 
-			fmt.Println("OK")
-			remaining--
-			totalSize = totalSize - file.Size
+	// prepare update statement
+	stmtUpdate, err := tx.Prepare("UPDATE files SET checksum_ok = ?, checked = ? WHERE id = ?")
+	checkErr(err)
+	defer stmtUpdate.Close()
+	stmtNotFound, err := tx.Prepare("UPDATE files SET file_found = 0 WHERE id = ?")
+	checkErr(err)
+	defer stmtNotFound.Close()
+
+	readErrors := 0
+	for _, file := range files {
+		if !checkFile(tx, stmtUpdate, stmtNotFound, basepath+file.Name, file, progress) {
+			readErrors++
 		}
+	}
+	checkErr(tx.Commit())
+	return readErrors
+}
+
+// checkFile compares the checksum of one file and records the result.
+// It returns false if the file could not be read.
+func checkFile(tx *sql.Tx, stmtUpdate *sql.Stmt, stmtNotFound *sql.Stmt, path string, file File, progress *Progress) bool {
+	progress.StartFile(path)
+	defer progress.FinishFile(file.Size)
 
-		stmtUpdate.Close()
-		stmtNotFound.Close()
-		fmt.Println("Committing...")
-		err = tx.Commit()
+	f, err := os.Open(path)
+	if err != nil {
+		// file not found
+		_, err = stmtNotFound.Exec(file.ID)
 		checkErr(err)
+		return true
 	}
+	f.Close()
 
+	hash, damaged, err := verifyChunks(tx, file, path, progress)
+	if err != nil {
+		progress.Println("read error:", path, err)
+		return false
+	}
+	if hash == file.Checksum {
+		_, err = stmtUpdate.Exec(1, time.Now().Unix(), file.ID)
+		checkErr(err)
+		return true
+	}
+	_, err = stmtUpdate.Exec(0, time.Now().Unix(), file.ID)
+	checkErr(err)
+	progress.Println("changed:", path)
+	for _, r := range formatRanges(damaged, file.Size) {
+		progress.Println("    damaged:", r)
+	}
+	return true
 }
 
 // ByteSize displays bytes in human-readable format
@@ -730,6 +926,11 @@ func reverse(s string) string {
 
 // HashFile takes a path and returns a hash
 func HashFile(path string) (hash string, err error) {
+	return hashFile(path, ioutil.Discard)
+}
+
+// hashFile is HashFile reporting the bytes read to progress
+func hashFile(path string, progress io.Writer) (hash string, err error) {
 
 	file, err := os.Open(path)
 	if err != nil {
@@ -739,7 +940,7 @@ func HashFile(path string) (hash string, err error) {
 	defer file.Close()
 
 	hasher := sha256.New()
-	_, err = io.Copy(hasher, file)
+	_, err = io.Copy(io.MultiWriter(hasher, progress), file)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DedupeOptions controls which copy is kept and what happens to the others
+type DedupeOptions struct {
+	Keep   string // oldest, newest or shortest
+	Prefer string // keep the copy below this directory if there is one
+	Action string // hardlink, reflink, symlink or delete
+	Dir    string // only groups with a copy below this directory
+	DryRun bool   // only show the plan
+}
+
+var dedupeActions = map[string]func(keep string, dup string) error{
+	"hardlink": replaceWithHardlink,
+	"reflink":  replaceWithReflink,
+	"symlink":  replaceWithSymlink,
+	"delete":   removeDuplicate,
+}
+
+// chooseKeeper returns the index of the copy to keep
+func chooseKeeper(files []Record, opts DedupeOptions, prefer string) int {
+	candidates := files
+	if prefer != "" {
+		var preferred []Record
+		for _, f := range files {
+			if strings.HasPrefix(f.Path, prefer) {
+				preferred = append(preferred, f)
+			}
+		}
+		if len(preferred) > 0 {
+			candidates = preferred
+		}
+	}
+
+	best := candidates[0]
+	for _, f := range candidates[1:] {
+		switch opts.Keep {
+		case "newest":
+			if f.Mtime > best.Mtime {
+				best = f
+			}
+		case "shortest":
+			if len(f.Path) < len(best.Path) {
+				best = f
+			}
+		default:
+			if f.Mtime < best.Mtime {
+				best = f
+			}
+		}
+	}
+	for i, f := range files {
+		if f.ID == best.ID {
+			return i
+		}
+	}
+	return 0
+}
+
+// Dedupe keeps one copy of every group of duplicates and replaces the others
+func (db *DB) Dedupe(opts DedupeOptions) error {
+	action, ok := dedupeActions[opts.Action]
+	if !ok {
+		return fmt.Errorf("unknown action %q, use hardlink, reflink, symlink or delete", opts.Action)
+	}
+	if opts.Keep != "oldest" && opts.Keep != "newest" && opts.Keep != "shortest" {
+		return fmt.Errorf("unknown policy %q, use oldest, newest or shortest", opts.Keep)
+	}
+
+	// get basepath
+	basepath, err := db.GetOption("basepath")
+	checkErr(err)
+
+	prefer := ""
+	if opts.Prefer != "" {
+		prefer = strings.TrimRight(basepath+normalizeSelection(basepath, []string{opts.Prefer})[0], "/") + "/"
+	}
+
+	groups, err := db.FindDuplicates(DuplicateOptions{Dir: opts.Dir})
+	if err != nil {
+		return err
+	}
+
+	var freed int64
+	done, failed := 0, 0
+	for _, g := range groups {
+		k := chooseKeeper(g.Files, opts, prefer)
+		keep := g.Files[k]
+		fmt.Printf("keep %v\n", keep.Path)
+
+		for i, dup := range g.Files {
+			if i == k {
+				continue
+			}
+
+			same, err := sameInode(keep.Path, dup.Path)
+			if err == nil && same {
+				fmt.Printf("    already linked: %v\n", dup.Path)
+				continue
+			}
+
+			if opts.DryRun {
+				fmt.Printf("    %v %v\n", opts.Action, dup.Path)
+				freed += g.Size
+				done++
+				continue
+			}
+
+			// never trust the database alone before touching a file
+			err = compareFiles(keep.Path, dup.Path)
+			if err == nil {
+				err = action(keep.Path, dup.Path)
+			}
+			if err != nil {
+				fmt.Printf("    FAILED %v %v: %v\n", opts.Action, dup.Path, err)
+				failed++
+				continue
+			}
+			fmt.Printf("    %v %v\n", opts.Action, dup.Path)
+			freed += g.Size
+			done++
+
+			err = db.updateDeduped(dup, opts.Action)
+			checkErr(err)
+		}
+	}
+
+	if opts.DryRun {
+		fmt.Printf("dry run: %v files would be replaced, %v freed\n", done, ByteSize(freed))
+	} else {
+		fmt.Printf("%v files replaced, %v freed, %v failed\n", done, ByteSize(freed), failed)
+	}
+	return nil
+}
+
+// updateDeduped brings the database in line with a replaced duplicate
+func (db *DB) updateDeduped(dup Record, action string) error {
+	if action == "delete" || action == "symlink" {
+		// symlinks are not collected, so the copy is gone for checksummer
+		return db.forgetFile(dup.ID)
+	}
+
+	fi, err := os.Stat(dup.Path)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE files SET filesize = ?, mtime = ? WHERE id = ?", fi.Size(), fi.ModTime().Unix(), dup.ID)
+	return err
+}
+
+func sameInode(a string, b string) (bool, error) {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(fa, fb), nil
+}
+
+// compareFiles checks byte by byte that both files have the same content
+func compareFiles(a string, b string) error {
+	fa, err := os.Open(a)
+	if err != nil {
+		return err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return err
+	}
+	defer fb.Close()
+
+	ra := bufio.NewReaderSize(fa, 1<<20)
+	rb := bufio.NewReaderSize(fb, 1<<20)
+	bufA := make([]byte, 64<<10)
+	bufB := make([]byte, 64<<10)
+	for {
+		na, errA := io.ReadFull(ra, bufA)
+		nb, errB := io.ReadFull(rb, bufB)
+		if na != nb || !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return fmt.Errorf("content differs from %v", a)
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			if errB == io.EOF || errB == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return fmt.Errorf("content differs from %v", a)
+		}
+		if errA != nil {
+			return errA
+		}
+		if errB != nil {
+			return errB
+		}
+	}
+}
+
+// replaceFile atomically moves the replacement created by create over dup.
+// The temporary name next to dup is unique to this process and run; create
+// must fail if it exists, so that no other file is touched.
+func replaceFile(dup string, create func(tmp string) error) error {
+	tmp := fmt.Sprintf("%v.checksummer-%d-%d.tmp", dup, os.Getpid(), time.Now().UnixNano())
+	err := create(tmp)
+	if os.IsExist(err) {
+		return fmt.Errorf("temporary file %v exists", tmp)
+	}
+	if err != nil {
+		// a failed reflink leaves its file behind
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dup)
+}
+
+func removeDuplicate(keep string, dup string) error {
+	return os.Remove(dup)
+}
+
+func replaceWithHardlink(keep string, dup string) error {
+	return replaceFile(dup, func(tmp string) error {
+		return os.Link(keep, tmp)
+	})
+}
+
+func replaceWithSymlink(keep string, dup string) error {
+	target, err := filepath.Abs(keep)
+	if err != nil {
+		return err
+	}
+	return replaceFile(dup, func(tmp string) error {
+		return os.Symlink(target, tmp)
+	})
+}
+
+func replaceWithReflink(keep string, dup string) error {
+	fi, err := os.Stat(dup)
+	if err != nil {
+		return err
+	}
+	return replaceFile(dup, func(tmp string) error {
+		src, err := os.Open(keep)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		err = reflink(src, dst)
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(tmp, fi.ModTime(), fi.ModTime())
+	})
+}
+
+func cmdDedupe(db *DB, args []string) error {
+	flags := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	action := flags.String("action", "", "replace duplicates by hardlink, reflink, symlink or delete them")
+	keep := flags.String("keep", "oldest", "copy to keep: oldest, newest or shortest path")
+	prefer := flags.String("prefer", "", "keep the copy below this directory if there is one")
+	dir := flags.String("dir", "", "only groups with a copy below this directory")
+	dryRun := flags.Bool("n", false, "dry run, only show the plan")
+	flags.Parse(args)
+
+	return db.Dedupe(DedupeOptions{Keep: *keep, Prefer: *prefer, Action: *action, Dir: *dir, DryRun: *dryRun})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplaceWithHardlink(t *testing.T) {
+	dir := t.TempDir()
+	keep := filepath.Join(dir, "keep")
+	dup := filepath.Join(dir, "dup")
+	for _, path := range []string{keep, dup} {
+		err := ioutil.WriteFile(path, []byte("same"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// other files next to dup are not touched
+	old := dup + ".checksummer-tmp"
+	err := ioutil.WriteFile(old, []byte("other"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = replaceWithHardlink(keep, dup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := os.Stat(keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(dup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Error("dup is not a hardlink of keep")
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 3 {
+		t.Errorf("files left: %v", names)
+	}
+	if content, _ := ioutil.ReadFile(old); string(content) != "other" {
+		t.Errorf("%v was changed", old)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// maxDirsPerChecksum limits how many directories may hold a file with the same
+// checksum for it to count as evidence for near-duplicates; empty files and the
+// like are everywhere. Only the directories of the files count, not their parents.
+const maxDirsPerChecksum = 100
+
+// dirNode is a directory with the checksums of everything below it
+type dirNode struct {
+	path     string
+	parent   *dirNode
+	files    map[string]Record
+	dirs     map[string]*dirNode // name: subdirectory
+	size     int64
+	count    int
+	complete bool // every file below has a checksum
+	hash     string
+	sums     map[string]bool // distinct checksums of all files below
+}
+
+// DirectoryGroup is a set of identical directory trees
+type DirectoryGroup struct {
+	Hash  string
+	Size  int64
+	Count int
+	Dirs  []string
+}
+
+// SimilarDirectories is a pair of directories sharing most of their files
+type SimilarDirectories struct {
+	A, B       *dirNode
+	Shared     int
+	Similarity float64
+}
+
+// Size returns the size of the larger directory
+func (s SimilarDirectories) Size() int64 {
+	if s.A.size > s.B.size {
+		return s.A.size
+	}
+	return s.B.size
+}
+
+// loadDirectoryTree builds the directory tree of all found files
+func (db *DB) loadDirectoryTree() (map[string]*dirNode, error) {
+	records, err := db.queryRecords(`SELECT id, filename, filesize, mtime, checksum_sha256
+                                      FROM files
+                                      WHERE file_found = '1'`)
+	if err != nil {
+		return nil, err
+	}
+
+	// get basepath
+	basepath, err := db.GetOption("basepath")
+	checkErr(err)
+
+	dirs := make(map[string]*dirNode)
+	var getDir func(p string) *dirNode
+	getDir = func(p string) *dirNode {
+		if d, ok := dirs[p]; ok {
+			return d
+		}
+		d := &dirNode{path: p, files: map[string]Record{}, dirs: map[string]*dirNode{}, complete: true, sums: map[string]bool{}}
+		dirs[p] = d
+		if p != "/" {
+			d.parent = getDir(path.Dir(p))
+			d.parent.dirs[path.Base(p)] = d
+		}
+		return d
+	}
+
+	for _, r := range records {
+		filename := strings.TrimPrefix(r.Path, basepath)
+		d := getDir(path.Dir(filename))
+		d.files[path.Base(filename)] = r
+		for ; d != nil; d = d.parent {
+			d.size += r.Size
+			d.count++
+			if r.Checksum == "" {
+				d.complete = false
+			} else if r.Size > 0 {
+				d.sums[r.Checksum] = true
+			}
+		}
+	}
+
+	return dirs, nil
+}
+
+// treeHash computes the Merkle hash of a directory from the names and
+// checksums of its files and the hashes of its subdirectories
+func (d *dirNode) treeHash() string {
+	if d.hash != "" || !d.complete {
+		return d.hash
+	}
+	var lines []string
+	for name, r := range d.files {
+		lines = append(lines, "f "+name+" "+r.Checksum)
+	}
+	for name, sub := range d.dirs {
+		lines = append(lines, "d "+name+" "+sub.treeHash())
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	d.hash = hex.EncodeToString(sum[:])
+	return d.hash
+}
+
+// containsCopy reports whether a is a parent directory of b or of an identical copy of b
+func containsCopy(a *dirNode, b *dirNode) bool {
+	for p := b.parent; p != nil; p = p.parent {
+		if p == a || (p.complete && a.complete && p.hash == a.hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// FindDuplicateDirectories returns identical directory trees and pairs of
+// directories sharing at least minSimilarity percent of their files, largest first.
+// Directories inside a reported identical tree are left out.
+func (db *DB) FindDuplicateDirectories(minSimilarity int) ([]DirectoryGroup, []SimilarDirectories, error) {
+	dirs, err := db.loadDirectoryTree()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byHash := make(map[string][]*dirNode)
+	for _, d := range dirs {
+		d.treeHash()
+	}
+	for _, d := range dirs {
+		if d.complete && d.size > 0 {
+			byHash[d.hash] = append(byHash[d.hash], d)
+		}
+	}
+
+	// a copied tree also makes all of its subdirectories identical,
+	// only report the topmost ones
+	duplicated := func(d *dirNode) bool {
+		return d != nil && d.complete && len(byHash[d.hash]) > 1
+	}
+
+	var groups []DirectoryGroup
+	for hash, nodes := range byHash {
+		if len(nodes) < 2 {
+			continue
+		}
+		topmost := false
+		for _, d := range nodes {
+			if !duplicated(d.parent) {
+				topmost = true
+			}
+		}
+		if !topmost {
+			continue
+		}
+		g := DirectoryGroup{Hash: hash, Size: nodes[0].size, Count: nodes[0].count}
+		for _, d := range nodes {
+			g.Dirs = append(g.Dirs, d.path)
+		}
+		sort.Strings(g.Dirs)
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Size != groups[j].Size {
+			return groups[i].Size > groups[j].Size
+		}
+		return groups[i].Dirs[0] < groups[j].Dirs[0]
+	})
+
+	if minSimilarity <= 0 || minSimilarity > 100 {
+		return groups, nil, nil
+	}
+
+	// copies of identical trees would all show up in the same pairs,
+	// only compare the first of them
+	canonical := func(d *dirNode) bool {
+		if !duplicated(d) {
+			return true
+		}
+		for _, other := range byHash[d.hash] {
+			if other.path < d.path {
+				return false
+			}
+		}
+		return true
+	}
+
+	// count shared checksums for every pair of directories having one in common
+	byChecksum := make(map[string][]*dirNode)
+	holders := make(map[string]int)
+	for _, d := range dirs {
+		if !canonical(d) {
+			continue
+		}
+		for checksum := range d.sums {
+			byChecksum[checksum] = append(byChecksum[checksum], d)
+		}
+		held := make(map[string]bool)
+		for _, r := range d.files {
+			if r.Checksum != "" && r.Size > 0 && !held[r.Checksum] {
+				held[r.Checksum] = true
+				holders[r.Checksum]++
+			}
+		}
+	}
+	type pair struct{ a, b *dirNode }
+	shared := make(map[pair]int)
+	for checksum, nodes := range byChecksum {
+		if len(nodes) < 2 || holders[checksum] > maxDirsPerChecksum {
+			continue
+		}
+		for i, a := range nodes {
+			for _, b := range nodes[i+1:] {
+				if a.path < b.path {
+					shared[pair{a, b}]++
+				} else {
+					shared[pair{b, a}]++
+				}
+			}
+		}
+	}
+
+	var similar []SimilarDirectories
+	for p, n := range shared {
+		if p.a.complete && p.b.complete && p.a.hash == p.b.hash {
+			continue
+		}
+		if containsCopy(p.a, p.b) || containsCopy(p.b, p.a) {
+			continue
+		}
+		total := len(p.a.sums)
+		if len(p.b.sums) > total {
+			total = len(p.b.sums)
+		}
+		s := SimilarDirectories{A: p.a, B: p.b, Shared: n, Similarity: float64(n) * 100 / float64(total)}
+		if s.Similarity >= float64(minSimilarity) {
+			similar = append(similar, s)
+		}
+	}
+
+	// like identical trees, only report the topmost similar pairs
+	reported := make(map[pair]bool)
+	for _, s := range similar {
+		reported[pair{s.A, s.B}] = true
+	}
+	var topmost []SimilarDirectories
+	for _, s := range similar {
+		a, b := s.A.parent, s.B.parent
+		if a != nil && b != nil {
+			if a.path > b.path {
+				a, b = b, a
+			}
+			if reported[pair{a, b}] {
+				continue
+			}
+		}
+		topmost = append(topmost, s)
+	}
+	sort.Slice(topmost, func(i, j int) bool {
+		if topmost[i].Size() != topmost[j].Size() {
+			return topmost[i].Size() > topmost[j].Size()
+		}
+		return topmost[i].A.path < topmost[j].A.path
+	})
+	return groups, topmost, nil
+}
+
+// ListDuplicateDirectories lists identical and similar directories
+func (db *DB) ListDuplicateDirectories(minSimilarity int) error {
+	groups, similar, err := db.FindDuplicateDirectories(minSimilarity)
+	if err != nil {
+		return err
+	}
+
+	// get basepath
+	basepath, err := db.GetOption("basepath")
+	checkErr(err)
+
+	if outputFormat != "text" {
+		// identical trees carry their tree hash, similar pairs the other directory as source
+		var records []Record
+		for _, g := range groups {
+			for _, dir := range g.Dirs {
+				records = append(records, Record{Path: basepath + dir, Size: g.Size, Checksum: g.Hash, Count: int64(len(g.Dirs))})
+			}
+		}
+		for _, s := range similar {
+			records = append(records, Record{Path: basepath + s.A.path, Size: s.A.size, Count: int64(s.Shared), Source: basepath + s.B.path})
+		}
+		return writeRecords(records, nil)
+	}
+
+	var buffer bytes.Buffer
+	var wasted int64
+	for _, g := range groups {
+		wasted += g.Size * int64(len(g.Dirs)-1)
+		buffer.WriteString(fmt.Sprintf("%v identical directories of %v, %v files\n", len(g.Dirs), ByteSize(g.Size), g.Count))
+		for _, dir := range g.Dirs {
+			buffer.WriteString(fmt.Sprintf("    %v\n", basepath+dir))
+		}
+	}
+	buffer.WriteString(fmt.Sprintf("%v groups of identical directories, %v wasted\n", len(groups), ByteSize(wasted)))
+
+	if minSimilarity > 0 && minSimilarity <= 100 {
+		buffer.WriteString("\n")
+		for _, s := range similar {
+			buffer.WriteString(fmt.Sprintf("%.0f%% alike, %v of their files shared\n", s.Similarity, s.Shared))
+			for _, d := range []*dirNode{s.A, s.B} {
+				buffer.WriteString(fmt.Sprintf("    %8v  %6v files    %v\n", ByteSize(d.size), d.count, basepath+d.path))
+			}
+		}
+		buffer.WriteString(fmt.Sprintf("%v pairs of directories at least %v%% alike\n", len(similar), minSimilarity))
+	}
+	pager(buffer.String())
+	return nil
+}
+
+func cmdDuplicateDirectories(db *DB, args []string) error {
+	flags := flag.NewFlagSet("dupdirs", flag.ExitOnError)
+	format := formatFlag(flags)
+	similar := flags.Int("similar", 95, "also list directories sharing at least this percentage of their files, 0 to disable")
+	flags.Parse(args)
+	err := setFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	return db.ListDuplicateDirectories(*similar)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSimilarDirectoriesInDeepTrees(t *testing.T) {
+	// two albums deep enough that each file has more ancestors than
+	// maxDirsPerChecksum, differing in one file
+	deep := "/" + strings.Repeat("x/", maxDirsPerChecksum)
+	var files []string
+	for _, album := range []string{"a", "b"} {
+		for i := 0; i < 20; i++ {
+			files = append(files, fmt.Sprintf("%v%v/%v.jpg", deep, album, i))
+		}
+	}
+	db := testDB(t, files...)
+	_, err := db.Exec(`UPDATE files SET checksum_sha256 = substr(filename, -6)
+                       WHERE filename NOT LIKE '%/b/19.jpg'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("UPDATE files SET checksum_sha256 = 'other' WHERE filename LIKE '%/b/19.jpg'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, similar, err := db.FindDuplicateDirectories(90)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(similar) != 1 || similar[0].A.path != deep+"a" || similar[0].B.path != deep+"b" || similar[0].Shared != 19 {
+		for _, s := range similar {
+			t.Logf("%v %v %v", s.A.path, s.B.path, s.Shared)
+		}
+		t.Fatalf("%v similar pairs, want a and b", len(similar))
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DuplicateGroup holds all copies of the same content
+type DuplicateGroup struct {
+	Checksum string   `json:"checksum"`
+	Size     int64    `json:"size"`
+	Files    []Record `json:"files"`
+}
+
+// Wasted returns the space that would be freed by keeping a single copy
+func (g DuplicateGroup) Wasted() int64 {
+	return g.Size * int64(len(g.Files)-1)
+}
+
+// DuplicateOptions controls the duplicate report
+type DuplicateOptions struct {
+	Sort string // wasted, count or path
+	Dir  string // only groups with a copy below this directory
+	Fast bool   // find candidates by size and partial hashes, no need for mc
+}
+
+// partialSize is how much of the start and the end of a file is hashed to
+// tell apart candidates of the same size
+const partialSize = 4096
+
+// FindDuplicates returns the groups of found, hashed files with the same checksum
+func (db *DB) FindDuplicates(opts DuplicateOptions) ([]DuplicateGroup, error) {
+
+	// get basepath
+	basepath, err := db.GetOption("basepath")
+	checkErr(err)
+
+	dir := ""
+	if opts.Dir != "" {
+		dir = normalizeSelection(basepath, []string{opts.Dir})[0]
+		dir = basepath + strings.TrimRight(dir, "/") + "/"
+	}
+
+	var records []Record
+	if opts.Fast {
+		records, err = db.findDuplicateCandidates(dir)
+	} else {
+		records, err = db.queryRecords(`SELECT id, filename, filesize, mtime, checksum_sha256
+                                      FROM files
+                                      WHERE file_found = '1'
+                                      AND checksum_sha256 IN (
+                                          SELECT checksum_sha256
+                                          FROM files
+                                          WHERE file_found = '1'
+                                          AND checksum_sha256 IS NOT NULL
+                                          GROUP BY checksum_sha256
+                                          HAVING COUNT(id) > 1)
+                                      ORDER BY checksum_sha256, filename`)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []DuplicateGroup
+	for i := 0; i < len(records); {
+		g := DuplicateGroup{Checksum: records[i].Checksum, Size: records[i].Size}
+		inDir := dir == ""
+		for ; i < len(records) && records[i].Checksum == g.Checksum; i++ {
+			g.Files = append(g.Files, records[i])
+			if strings.HasPrefix(records[i].Path, dir) {
+				inDir = true
+			}
+		}
+		if inDir {
+			groups = append(groups, g)
+		}
+	}
+
+	switch opts.Sort {
+	case "count":
+		sort.SliceStable(groups, func(i, j int) bool { return len(groups[i].Files) > len(groups[j].Files) })
+	case "path":
+		sort.SliceStable(groups, func(i, j int) bool { return groups[i].Files[0].Path < groups[j].Files[0].Path })
+	case "wasted", "":
+		sort.SliceStable(groups, func(i, j int) bool { return groups[i].Wasted() > groups[j].Wasted() })
+	default:
+		return nil, fmt.Errorf("unknown sort order %q, use wasted, count or path", opts.Sort)
+	}
+	return groups, nil
+}
+
+// findDuplicateCandidates finds duplicates without relying on stored checksums.
+// Files are grouped by size, same-size files by a hash of their first and
+// last few KiB, and only files that still collide are hashed completely.
+// Stored checksums are used where present, the new ones are saved like mc
+// would. Unreadable files are skipped and reported. With dir set, only
+// groups with a file below it are hashed. The result is ordered by checksum
+// like the rows of FindDuplicates.
+func (db *DB) findDuplicateCandidates(dir string) ([]Record, error) {
+	candidates, err := db.queryRecords(`SELECT id, filename, filesize, mtime, checksum_sha256
+                                         FROM files
+                                         WHERE file_found = '1'
+                                         AND filesize IN (
+                                             SELECT filesize
+                                             FROM files
+                                             WHERE file_found = '1'
+                                             GROUP BY filesize
+                                             HAVING COUNT(id) > 1)
+                                         ORDER BY filesize, filename`)
+	if err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		// only sizes with a file below dir
+		below := make(map[int64]bool)
+		for _, r := range candidates {
+			if strings.HasPrefix(r.Path, dir) {
+				below[r.Size] = true
+			}
+		}
+		var inDir []Record
+		for _, r := range candidates {
+			if below[r.Size] {
+				inDir = append(inDir, r)
+			}
+		}
+		candidates = inDir
+	}
+
+	// same size and same partial hash
+	groups := make(map[string][]Record)
+	partials := make(map[int64]string)
+	var keys []string
+	var skipped []error
+	for _, r := range candidates {
+		partial, err := hashPartial(r.Path, r.Size)
+		if err != nil {
+			// vanished since the last collect, or unreadable
+			if !os.IsNotExist(err) {
+				skipped = append(skipped, err)
+			}
+			continue
+		}
+		partials[r.ID] = partial
+		key := fmt.Sprintf("%d:%s", r.Size, partial)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], r)
+	}
+
+	var remaining []Record
+	var remainingSize int64
+	for _, key := range keys {
+		g := groups[key]
+		if len(g) < 2 || !hasFileBelow(g, dir) {
+			continue
+		}
+		for _, r := range g {
+			if r.Checksum == "" {
+				remaining = append(remaining, r)
+				remainingSize += r.Size
+			}
+		}
+	}
+
+	// the progress line would garble machine readable output
+	var progress *Progress
+	var w io.Writer = ioutil.Discard
+	if outputFormat == "text" {
+		progress = NewProgress("hashing candidates", len(remaining), remainingSize)
+		w = progress
+	}
+	// block-level checksums, 0 = disabled
+	chunksize := db.GetChunksize()
+
+	hashes := make(map[int64]string)
+	chunks := make(map[int64][]string)
+	for _, r := range remaining {
+		if progress != nil {
+			progress.StartFile(r.Path)
+		}
+		var hash string
+		switch {
+		case chunksize > 0:
+			hash, chunks[r.ID], err = hashFileChunks(r.Path, chunksize, w)
+		case r.Size <= 2*partialSize:
+			// the partial hash already covered the whole file
+			hash = partials[r.ID]
+		default:
+			hash, err = hashFile(r.Path, w)
+		}
+		if progress != nil {
+			progress.FinishFile(r.Size)
+		}
+		if err != nil {
+			skipped = append(skipped, err)
+			continue
+		}
+		hashes[r.ID] = hash
+	}
+	if progress != nil {
+		progress.Finish()
+	}
+	for _, err := range skipped {
+		fmt.Fprintln(os.Stderr, "skipped:", err)
+	}
+
+	err = db.saveChecksums(hashes, chunksize, chunks)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "saving the checksums failed:", err)
+	}
+
+	var records []Record
+	for _, key := range keys {
+		g := groups[key]
+		if len(g) < 2 || !hasFileBelow(g, dir) {
+			continue
+		}
+		for _, r := range g {
+			if r.Checksum == "" {
+				r.Checksum = hashes[r.ID]
+				if r.Checksum == "" {
+					continue
+				}
+			}
+			records = append(records, r)
+		}
+	}
+
+	// full hashes can still differ, drop files without a copy
+	count := make(map[string]int)
+	for _, r := range records {
+		count[r.Checksum]++
+	}
+	var duplicates []Record
+	for _, r := range records {
+		if count[r.Checksum] > 1 {
+			duplicates = append(duplicates, r)
+		}
+	}
+	sort.SliceStable(duplicates, func(i, j int) bool {
+		if duplicates[i].Checksum != duplicates[j].Checksum {
+			return duplicates[i].Checksum < duplicates[j].Checksum
+		}
+		return duplicates[i].Path < duplicates[j].Path
+	})
+	return duplicates, nil
+}
+
+// hasFileBelow reports whether one of the records is below dir
+func hasFileBelow(records []Record, dir string) bool {
+	for _, r := range records {
+		if strings.HasPrefix(r.Path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// saveChecksums stores the checksums of files that had none, with their
+// block-level checksums if enabled. They change what the manifest covers,
+// so this takes the write lock, which only checks and rehashes the
+// directories changed since the last manifest. While another process
+// holds it the checksums are not saved, the report does not need them.
+func (db *DB) saveChecksums(hashes map[int64]string, chunksize int64, chunks map[int64][]string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	err := db.Lock("duplicates")
+	if err != nil {
+		return err
+	}
+	defer db.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for id, hash := range hashes {
+		res, err := tx.Exec("UPDATE files SET checksum_sha256 = ? WHERE id = ? AND checksum_sha256 IS NULL", hash, id)
+		if err != nil {
+			return err
+		}
+		updated, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if updated > 0 && chunksize > 0 {
+			err = saveChunks(tx, id, chunksize, chunks[id])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// hashPartial hashes the first and the last partialSize bytes of a file.
+// Files up to twice that size are hashed completely, which gives the same
+// checksum as hashFile.
+func hashPartial(path string, size int64) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if size <= 2*partialSize {
+		_, err = io.Copy(hasher, file)
+	} else {
+		_, err = io.CopyN(hasher, file, partialSize)
+		if err == nil {
+			_, err = file.Seek(-partialSize, io.SeekEnd)
+		}
+		if err == nil {
+			_, err = io.Copy(hasher, file)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// ListDuplicates returns a list of duplicate files, grouped by content
+func (db *DB) ListDuplicates(opts DuplicateOptions) error {
+	groups, err := db.FindDuplicates(opts)
+	if err != nil {
+		return err
+	}
+
+	if outputFormat != "text" {
+		var records []Record
+		for _, g := range groups {
+			for _, r := range g.Files {
+				r.Count = int64(len(g.Files))
+				records = append(records, r)
+			}
+		}
+		return writeRecords(records, nil)
+	}
+
+	var buffer bytes.Buffer
+	var wasted int64
+	for _, g := range groups {
+		wasted += g.Wasted()
+		buffer.WriteString(fmt.Sprintf("%v copies of %v, %v wasted, sha256 %v\n",
+			len(g.Files), ByteSize(g.Size), ByteSize(g.Wasted()), g.Checksum))
+		for _, r := range g.Files {
+			formattedDate := time.Unix(r.Mtime, 0).Format("2006-01-02 15:04:05")
+			buffer.WriteString(fmt.Sprintf("    %v    %v\n", formattedDate, r.Path))
+		}
+	}
+	buffer.WriteString(fmt.Sprintf("%v groups of duplicates, %v wasted\n", len(groups), ByteSize(wasted)))
+	pager(buffer.String())
+	return nil
+}
+
+func cmdDuplicates(db *DB, args []string) error {
+	flags := flag.NewFlagSet("duplicates", flag.ExitOnError)
+	format := formatFlag(flags)
+	sortBy := flags.String("sort", "wasted", "sort groups by wasted, count or path")
+	dir := flags.String("dir", "", "only groups with a copy below this directory")
+	fast := flags.Bool("fast", false, "find duplicates by size and partial hashes, without making checksums first")
+	flags.Parse(args)
+	err := setFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	return db.ListDuplicates(DuplicateOptions{Sort: *sortBy, Dir: *dir, Fast: *fast})
+}
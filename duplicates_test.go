@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFastDuplicatesSaveChecksums(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("x"), 3*partialSize)
+	other := append(bytes.Repeat([]byte("x"), 3*partialSize-1), 'y')
+	for name, data := range map[string][]byte{"a": content, "b": content, "c": other} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a directory cannot be read like a file
+	err := os.Mkdir(filepath.Join(dir, "unreadable"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := testDB(t)
+	err = db.SetOption("basepath", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/a", "/b", "/c", "/unreadable"} {
+		_, err = db.Exec("INSERT INTO files(filename, filesize, mtime, file_found) VALUES(?, ?, 1, 1)", name, len(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	groups, err := db.FindDuplicates(DuplicateOptions{Fast: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+	if len(groups) != 1 || len(groups[0].Files) != 2 || groups[0].Checksum != checksum {
+		t.Fatalf("groups %+v", groups)
+	}
+
+	saved, err := db.GetCount("SELECT count(*) FROM files WHERE checksum_sha256 = '" + checksum + "'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != 2 {
+		t.Errorf("%v checksums saved, want 2", saved)
+	}
+
+	// the manifest was updated with them
+	err = db.Lock("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Unlock()
+}
+
+func TestFastDuplicatesHashOnlyBelowDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"x/a": bytes.Repeat([]byte("a"), 3*partialSize),
+		"x/b": bytes.Repeat([]byte("a"), 3*partialSize),
+		"y/c": bytes.Repeat([]byte("c"), 4*partialSize),
+		"y/d": bytes.Repeat([]byte("c"), 4*partialSize),
+	}
+	db := testDB(t)
+	err := db.SetOption("basepath", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("INSERT INTO files(filename, filesize, mtime, file_found) VALUES(?, ?, 1, 1)", "/"+name, len(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	groups, err := db.FindDuplicates(DuplicateOptions{Fast: true, Dir: filepath.Join(dir, "x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || len(groups[0].Files) != 2 {
+		t.Fatalf("groups %+v", groups)
+	}
+	hashed, err := db.GetCount("SELECT count(*) FROM files WHERE checksum_sha256 IS NOT NULL AND filename LIKE '/y/%'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashed != 0 {
+		t.Errorf("%v files outside the directory hashed", hashed)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// The filename index is an FTS5 table with the trigram tokenizer, so it
+// answers the same substring searches as LIKE '%term%' without a full table
+// scan. Triggers keep it in sync with the files table, whichever operation
+// inserts, renames or prunes files. FTS5 needs the sqlite_fts5 build tag
+// (fts5 for the vendored driver), see the Makefile, and the trigram
+// tokenizer SQLite 3.34 or later, e.g. a system library linked with
+// -tags libsqlite3; without it search keeps using LIKE.
+
+// minIndexTerm is the shortest term the trigram index can look up
+const minIndexTerm = 3
+
+// HasFilenameIndex reports whether the trigram filename index has been
+// built and can be used by this SQLite build
+func (db *DB) HasFilenameIndex() bool {
+	var sql string
+	err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'files_fts'").Scan(&sql)
+	if err != nil || !strings.Contains(sql, "trigram") {
+		return false
+	}
+	_, err = db.Exec("SELECT rowid FROM files_fts LIMIT 0")
+	return err == nil
+}
+
+// sqliteAtLeast reports whether the linked SQLite is at least major.minor
+func (db *DB) sqliteAtLeast(major int, minor int) bool {
+	var version string
+	err := db.QueryRow("SELECT sqlite_version()").Scan(&version)
+	if err != nil {
+		return false
+	}
+	var ma, mi int
+	fmt.Sscanf(version, "%d.%d", &ma, &mi)
+	return ma > major || ma == major && mi >= minor
+}
+
+// BuildFilenameIndex creates the filename index and fills it from the files table
+func (db *DB) BuildFilenameIndex() error {
+	if !db.sqliteAtLeast(3, 34) {
+		var version string
+		db.QueryRow("SELECT sqlite_version()").Scan(&version)
+		return fmt.Errorf("the filename index needs SQLite 3.34 or later for the trigram tokenizer, this build has %v; "+
+			"build with -tags 'sqlite_fts5 libsqlite3' against a newer system library", version)
+	}
+	err := db.DropFilenameIndex()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("building filename index...")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`CREATE VIRTUAL TABLE files_fts USING fts5(
+                        filename,
+                        content = 'files',
+                        content_rowid = 'id',
+                        tokenize = 'trigram'
+                        )`,
+		`CREATE TRIGGER files_fts_insert AFTER INSERT ON files BEGIN
+                        INSERT INTO files_fts(rowid, filename) VALUES (new.id, new.filename);
+                        END`,
+		`CREATE TRIGGER files_fts_delete AFTER DELETE ON files BEGIN
+                        INSERT INTO files_fts(files_fts, rowid, filename) VALUES ('delete', old.id, old.filename);
+                        END`,
+		`CREATE TRIGGER files_fts_update AFTER UPDATE OF filename ON files BEGIN
+                        INSERT INTO files_fts(files_fts, rowid, filename) VALUES ('delete', old.id, old.filename);
+                        INSERT INTO files_fts(rowid, filename) VALUES (new.id, new.filename);
+                        END`,
+		`INSERT INTO files_fts(files_fts) VALUES ('rebuild')`,
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			fmt.Printf("FAILED\n")
+			if strings.Contains(err.Error(), "no such module") {
+				return fmt.Errorf("filename index needs SQLite with FTS5, build with -tags sqlite_fts5 (fts5 for the vendored driver): %v", err)
+			}
+			return fmt.Errorf("filename index not supported by this SQLite build: %v", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("OK\n")
+	return nil
+}
+
+// DropFilenameIndex removes the filename index, search falls back to LIKE
+func (db *DB) DropFilenameIndex() error {
+	for _, statement := range []string{
+		"DROP TRIGGER IF EXISTS files_fts_insert",
+		"DROP TRIGGER IF EXISTS files_fts_delete",
+		"DROP TRIGGER IF EXISTS files_fts_update",
+		"DROP TABLE IF EXISTS files_fts",
+	} {
+		_, err := db.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ftsPhrase quotes a term as an FTS5 phrase
+func ftsPhrase(term string) string {
+	return `"` + strings.Replace(term, `"`, `""`, -1) + `"`
+}
+
+func cmdIndex(db *DB, args []string) error {
+	flags := flag.NewFlagSet("index", flag.ExitOnError)
+	drop := flags.Bool("drop", false, "remove the filename index")
+	flags.Parse(args)
+
+	if *drop {
+		return db.DropFilenameIndex()
+	}
+	return db.BuildFilenameIndex()
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestFilenameIndexFindsSubstrings(t *testing.T) {
+	db := testDB(t, "/Photos/2020/a.jpg", "/myphotos/b.jpg", "/docs/c.txt")
+	err := db.BuildFilenameIndex()
+	if err != nil {
+		t.Skip(err)
+	}
+	if !db.HasFilenameIndex() {
+		t.Fatal("no index after building it")
+	}
+	for _, index := range []bool{false, true} {
+		query, err := ParseQuery("photo -2020")
+		if err != nil {
+			t.Fatal(err)
+		}
+		where, args := query.Where(index)
+		var found int
+		err = db.QueryRow("SELECT count(*) FROM files WHERE "+where, args...).Scan(&found)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != 1 {
+			t.Errorf("index %v: %v files, want 1", index, found)
+		}
+	}
+}
@@ -2,166 +2,424 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"strings"
 )
 
-// LaunchGUI starts the user interface
-func LaunchGUI(db *DB) {
+// stdin is shared by all prompts so that piped input is not lost between them
+var stdin = bufio.NewReader(os.Stdin)
+
+// inTUI is set while the full-screen interface owns the terminal
+var inTUI bool
+
+// Status holds the numbers shown in the header
+type Status struct {
+	Basepath     string
+	TotalSize    ByteSize
+	FilesInDB    int
+	DeletedFiles int
+	ChangedFiles int
+}
+
+// menuEntry is an action of the main menu; entries without key are section titles
+type menuEntry struct {
+	key    string
+	label  string
+	list   bool // the action shows its results in the viewer
+	action func()
+}
 
-	fmt.Printf("getting basepath...")
-	basepath, err := db.GetOption("basepath")
+// readLine prompts for a line of input
+func readLine(prompt string) string {
+	fmt.Print(prompt)
+	line, err := stdin.ReadString('\n')
+	if err == io.EOF && line == "" {
+		// nothing left to read, e.g. when input is piped
+		os.Exit(0)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+func loadStatus(db *DB) Status {
+	var s Status
+	var err error
+
+	s.Basepath, err = db.GetOption("basepath")
 	checkErr(err)
-	fmt.Printf("OK\n")
 
-	fmt.Printf("getting file count...")
-	filesInDB, err := db.GetCount("SELECT id FROM files LIMIT 1")
+	s.FilesInDB, err = db.GetCount("SELECT id FROM files LIMIT 1")
 	if err != nil {
-		filesInDB = 0
+		s.FilesInDB = 0
 	}
-	fmt.Printf("OK\n")
 
-	fmt.Printf("getting total filesize...")
 	ts, err := db.GetCount("SELECT sum(filesize) FROM files")
 	if err != nil {
 		ts = 0
 	}
-	totalSize := ByteSize(ts)
-	fmt.Printf("OK\n")
+	s.TotalSize = ByteSize(ts)
 
-	fmt.Printf("getting deleted files count...")
-	deletedFiles, err := db.GetCount("SELECT count(id) FROM files WHERE file_found = '0'")
+	s.DeletedFiles, err = db.GetCount("SELECT count(id) FROM files WHERE file_found = '0'")
 	if err != nil {
-		deletedFiles = 0
+		s.DeletedFiles = 0
 	}
-	fmt.Printf("OK\n")
 
-	fmt.Printf("getting changed files count...")
-	changedFiles, err := db.GetCount("SELECT count(id) FROM files WHERE checksum_ok = '0'")
+	s.ChangedFiles, err = db.GetCount("SELECT count(id) FROM files WHERE checksum_ok = '0'")
 	if err != nil {
-		changedFiles = 0
-	}
-	fmt.Printf("OK\n")
-
-	clearScreen()
-
-	fmt.Printf("Checksummer %v - filesystem intelligence", VERSION)
-	fmt.Println("")
-	fmt.Println("basepath is:", basepath)
-	fmt.Println("total size: ", totalSize)
-	fmt.Println("")
-	fmt.Println("=== Collection ===")
-	fmt.Println("[cf] collect files")
-	if filesInDB > 0 {
-		fmt.Println("[cd] check files in database")
-		fmt.Println("[mc] make checksums")
-		fmt.Println("[rc] reindex & check all files")
-		fmt.Println("[crc] continue reindex & checking")
-	}
-	fmt.Println("")
-	fmt.Println("=== Analysis ===")
-	if filesInDB > 0 {
-		fmt.Println("[s] search files")
-		fmt.Println("[r] rank by filesize")
-		fmt.Println("[m] recently modified files")
-		fmt.Println("[ld] list duplicate files")
-	}
-	if deletedFiles > 0 {
-		fmt.Printf("[d] show %v deleted files\n", deletedFiles)
-		fmt.Println("[pd] prune deleted files")
-	}
-	if changedFiles > 0 {
-		fmt.Printf("[ch] show %v changed files\n", changedFiles)
-		fmt.Println("[pc] prune changed files")
-	}
-	fmt.Println("")
-	fmt.Println("[cb] change basepath")
-	fmt.Println("[q] exit")
-	fmt.Println("")
-
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Print("Select: ")
-	choice, _ := reader.ReadString('\n')
-
-	choice = strings.Trim(choice, "\n")
-
-	switch choice {
-	case "cf":
-		db.CollectFiles()
-	case "cd":
-		db.CheckFilesDB()
-	case "cb":
-		db.ChangeBasepath()
-	case "mc":
-		db.MakeChecksums()
-	case "rc":
-		db.ReindexCheck(false)
-	case "crc":
-		db.ReindexCheck(true)
-	case "r":
-		db.RankFilesize()
-	case "s":
-		reader := bufio.NewReader(os.Stdin)
-		fmt.Print("Enter searchterm: ")
-		term, _ := reader.ReadString('\n')
-		term = strings.Trim(term, "\n")
-		db.Search(term)
-	case "m":
-		db.RankModified()
-	case "ld":
-		db.ListDuplicates()
-	case "d":
-		db.ShowDeleted()
-	case "pd":
-		db.PruneDeleted()
-	case "ch":
-		db.ShowChanged()
-	case "pc":
-		db.PruneChanged()
-	case "q":
+		s.ChangedFiles = 0
+	}
+
+	return s
+}
+
+func menuEntries(db *DB, s Status) []menuEntry {
+	var entries []menuEntry
+	add := func(key string, label string, action func()) {
+		// everything but listings writes to the database
+		if action != nil {
+			action = db.locked(label, action)
+		}
+		entries = append(entries, menuEntry{key: key, label: label, action: action})
+	}
+	addList := func(key string, label string, action func()) {
+		entries = append(entries, menuEntry{key: key, label: label, list: true, action: action})
+	}
+
+	add("", "=== Collection ===", nil)
+	add("cf", "collect files", db.CollectFiles)
+	if s.FilesInDB > 0 {
+		add("cd", "check files in database", db.CheckFilesDB)
+		add("mc", "make checksums", db.MakeChecksums)
+		add("rc", "reindex & check all files", func() { db.ReindexCheck(false) })
+		add("crc", "continue reindex & checking", func() { db.ReindexCheck(true) })
+		add("pg", "generate parity for files or folders", func() {
+			path := readLine("Enter file or folder: ")
+			err := db.MakeParity([]string{path}, 10)
+			if err != nil {
+				fmt.Println(err)
+			}
+		})
+	}
+
+	add("", "", nil)
+	add("", "=== Analysis ===", nil)
+	if s.FilesInDB > 0 {
+		addList("s", "search files", func() {
+			fmt.Println("e.g. holiday ext:jpg,png size>1M modified<2015 -re:/tmp/ is:changed sha:3f2a")
+			term := readLine("Enter search query: ")
+			err := db.Search(term)
+			if err != nil {
+				fmt.Println(err)
+				readLine("press [Enter] to continue")
+			}
+		})
+		addList("r", "rank by filesize", func() { db.RankFilesize() })
+		addList("m", "recently modified files", func() { db.RankModified() })
+		addList("ld", "list duplicate files", func() { db.ListDuplicates(DuplicateOptions{}) })
+		addList("lf", "find duplicates quickly, by size and partial hashes", func() { db.ListDuplicates(DuplicateOptions{Fast: true}) })
+		add("dd", "dedupe duplicate files", func() {
+			opts := DedupeOptions{Keep: "oldest"}
+			opts.Action = readLine("action [hardlink/reflink/symlink/delete]: ")
+			if keep := readLine("keep [oldest/newest/shortest]: "); keep != "" {
+				opts.Keep = keep
+			}
+			opts.Prefer = readLine("prefer copies below (optional): ")
+			opts.DryRun = true
+			err := db.Dedupe(opts)
+			if err == nil && readLine("apply? [y/N]: ") == "y" {
+				opts.DryRun = false
+				err = db.Dedupe(opts)
+			}
+			if err != nil {
+				fmt.Println(err)
+			}
+		})
+		add("sn", "take a snapshot of the file inventory", func() {
+			err := db.CreateSnapshot(readLine("snapshot name: "))
+			if err != nil {
+				fmt.Println(err)
+			}
+		})
+		addList("sd", "diff snapshots", func() {
+			db.ListSnapshots()
+			from := readLine("from snapshot: ")
+			to := readLine("to snapshot (empty for now): ")
+			err := db.DiffSnapshots(from, to)
+			if err != nil {
+				fmt.Println(err)
+				readLine("press [Enter] to continue")
+			}
+		})
+		addList("st", "statistics", func() { db.ShowStats(30) })
+		addList("du", "disk usage by directory", func() {
+			err := db.BrowseDiskUsage("")
+			if err != nil {
+				fmt.Println(err)
+			}
+		})
+		addList("dl", "list duplicate directories", func() { db.ListDuplicateDirectories(95) })
+		addList("w", "which: do I already have this file?", func() {
+			path := readLine("Enter path of the file: ")
+			err := db.Which([]string{path})
+			if err != nil {
+				fmt.Println(err)
+				readLine("press [Enter] to continue")
+			}
+		})
+	}
+	if s.DeletedFiles > 0 {
+		addList("d", fmt.Sprintf("show %v deleted files", s.DeletedFiles), func() { db.ShowDeleted() })
+		add("pd", "prune deleted files", func() { db.PruneDeleted() })
+	}
+	if s.ChangedFiles > 0 {
+		addList("ch", fmt.Sprintf("show %v changed files", s.ChangedFiles), func() { db.ShowChanged() })
+		add("pc", "prune changed files", func() { db.PruneChanged() })
+		add("rp", "repair changed files from backup", func() {
+			var opts RepairOptions
+			fmt.Println("Enter backup roots or checksummer databases, empty line to finish")
+			for {
+				source := readLine("source: ")
+				if source == "" {
+					break
+				}
+				opts.Sources = append(opts.Sources, source)
+			}
+			opts.DryRun = readLine("dry run? [Y/n]: ") != "n"
+			err := db.Repair(opts)
+			if err != nil {
+				fmt.Println(err)
+			}
+		})
+		add("rr", "reconstruct changed files from parity", func() {
+			err := db.ReconstructParity(false)
+			if err != nil {
+				fmt.Println(err)
+			}
+		})
+	}
+
+	add("", "", nil)
+	add("cb", "change basepath", func() { db.ChangeBasepath() })
+	add("cs", "change chunk size for block-level checksums", func() { db.ChangeChunksize() })
+	buildIndex := func() {
+		err := db.BuildFilenameIndex()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	if db.HasFilenameIndex() {
+		add("fi", "rebuild filename index", buildIndex)
+	} else {
+		add("fi", "build filename index for fast search", buildIndex)
+	}
+	add("q", "exit", nil)
+
+	return entries
+}
+
+// LaunchGUI starts the user interface
+func LaunchGUI(db *DB) {
+	if isTerminal(os.Stdin) && isTerminal(os.Stdout) {
+		launchTUI(db)
 		return
 	}
 
-	LaunchGUI(db)
+	// line based menu for dumb terminals and piped input
+	for {
+		s := loadStatus(db)
+		entries := menuEntries(db, s)
+
+		fmt.Printf("Checksummer %v - filesystem intelligence", VERSION)
+		fmt.Println("")
+		fmt.Println("basepath is:", s.Basepath)
+		fmt.Println("total size: ", s.TotalSize)
+		fmt.Println("")
+		for _, e := range entries {
+			if e.key == "" {
+				fmt.Println(e.label)
+			} else {
+				fmt.Printf("[%s] %s\n", e.key, e.label)
+			}
+		}
+		fmt.Println("")
+
+		choice := readLine("Select: ")
+		if choice == "q" {
+			return
+		}
+		for _, e := range entries {
+			if e.key == choice && e.action != nil {
+				e.action()
+			}
+		}
+	}
+}
+
+// tui is the full-screen main menu
+type tui struct {
+	db      *DB
+	status  Status
+	entries []menuEntry
+	cursor  int
+	input   string
+}
+
+func launchTUI(db *DB) {
+	inTUI = true
+	defer func() { inTUI = false }()
+
+	fmt.Print(altScreenOn)
+	defer fmt.Print(altScreenOff + cursorShow)
+
+	t := &tui{db: db}
+	for {
+		fmt.Print(clearAll + "loading...")
+		t.status = loadStatus(db)
+		t.entries = menuEntries(db, t.status)
+		if t.cursor >= len(t.entries) || t.entries[t.cursor].key == "" {
+			t.cursor = t.next(0, 1)
+		}
+
+		e, ok := t.choose()
+		if !ok {
+			return
+		}
+		t.run(e)
+	}
+}
 
+// next returns the next selectable entry from i in direction dir
+func (t *tui) next(i int, dir int) int {
+	for j := i; j >= 0 && j < len(t.entries); j += dir {
+		if t.entries[j].key != "" {
+			return j
+		}
+	}
+	return t.cursor
 }
 
-func clearScreen() {
-	fmt.Print("\033[H\033[2J")
+func (t *tui) header() string {
+	_, cols := terminalSize()
+	var buf bytes.Buffer
+	title := fmt.Sprintf(" Checksummer %v - filesystem intelligence", VERSION)
+	buf.WriteString(reverseOn + fmt.Sprintf("%-*s", cols, truncate(title, cols)) + attributesOff + "\r\n")
+	info := fmt.Sprintf(" basepath: %v   total size: %v", t.status.Basepath, t.status.TotalSize)
+	if t.status.DeletedFiles > 0 {
+		info += fmt.Sprintf("   deleted: %v", t.status.DeletedFiles)
+	}
+	if t.status.ChangedFiles > 0 {
+		info += fmt.Sprintf("   changed: %v", t.status.ChangedFiles)
+	}
+	buf.WriteString(truncate(info, cols) + "\r\n")
+	buf.WriteString(strings.Repeat("─", cols) + "\r\n")
+	return buf.String()
 }
 
-func pager(str string) {
+func (t *tui) draw() {
+	rows, cols := terminalSize()
+	height := rows - 5
 
-	// nasty bug forces me to scroll at the end (+G)
-	// otherwise, less may hang
-	// this hack will be replaced by the termui interface without less
-	cmd := exec.Command("less", "+G")
+	// scroll the menu when the terminal is too small
+	offset := 0
+	if t.cursor >= height {
+		offset = t.cursor - height + 1
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(cursorHide + clearAll + t.header())
+	for i := offset; i < len(t.entries) && i < offset+height; i++ {
+		e := t.entries[i]
+		switch {
+		case e.key == "":
+			buf.WriteString(boldOn + truncate(e.label, cols) + attributesOff)
+		case i == t.cursor:
+			buf.WriteString(reverseOn + truncate(fmt.Sprintf("[%s] %s", e.key, e.label), cols) + attributesOff)
+		default:
+			buf.WriteString(truncate(fmt.Sprintf("[%s] %s", e.key, e.label), cols))
+		}
+		buf.WriteString("\r\n")
+	}
 
-	// create a pipe (blocking)
-	r, stdin := io.Pipe()
+	buf.WriteString(fmt.Sprintf("\033[%d;1H", rows-1))
+	buf.WriteString(truncate(" ↑↓ select   Enter run   type a shortcut   q exit", cols) + "\r\n")
+	buf.WriteString(cursorShow + "Select: " + t.input)
+	os.Stdout.Write(buf.Bytes())
+}
 
-	// Set your i/o's
-	cmd.Stdin = r
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// choose lets the user pick a menu entry, returns false on exit
+func (t *tui) choose() (menuEntry, bool) {
+	restore, err := makeRaw()
+	checkErr(err)
+	defer restore()
 
-	// Create a blocking chan, Run the pager and unblock once it is finished
-	c := make(chan struct{})
-	go func() {
-		defer close(c)
-		cmd.Run()
-	}()
+	for {
+		t.draw()
+		key, r := readKey()
+		switch key {
+		case keyUp:
+			t.cursor = t.next(t.cursor-1, -1)
+			t.input = ""
+		case keyDown:
+			t.cursor = t.next(t.cursor+1, 1)
+			t.input = ""
+		case keyHome:
+			t.cursor = t.next(0, 1)
+		case keyEnd:
+			t.cursor = t.next(len(t.entries)-1, -1)
+		case keyEsc:
+			t.input = ""
+		case keyInterrupt:
+			return menuEntry{}, false
+		case keyBackspace:
+			if t.input != "" {
+				t.input = t.input[:len(t.input)-1]
+			}
+		case keyRune:
+			if r == 'q' && t.input == "" {
+				return menuEntry{}, false
+			}
+			t.input += string(r)
+			for i, e := range t.entries {
+				if e.key == t.input {
+					t.cursor = i
+				}
+			}
+		case keyEnter:
+			e := t.entries[t.cursor]
+			if t.input != "" && e.key != t.input {
+				// unknown shortcut
+				t.input = ""
+				continue
+			}
+			t.input = ""
+			if e.action == nil {
+				return menuEntry{}, false
+			}
+			return e, true
+		}
+	}
+}
 
-	// Pass anything to your pipe
-	fmt.Fprintf(stdin, str)
+// run executes an action below the pinned header, so that its output
+// scrolls while the status stays visible
+func (t *tui) run(e menuEntry) {
+	rows, _ := terminalSize()
+	fmt.Print(clearAll + t.header())
+	fmt.Printf("\033[4;%dr\033[4;1H", rows)
+	fmt.Print(cursorShow)
 
-	// Close stdin (result in pager to exit)
-	stdin.Close()
+	e.action()
 
-	// Wait for the pager to be finished
-	<-c
+	fmt.Print("\033[r")
+	if e.list {
+		return
+	}
 
+	fmt.Printf("\033[%d;1H\npress any key to return", rows)
+	restore, err := makeRaw()
+	checkErr(err)
+	readKey()
+	restore()
 }
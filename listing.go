@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// outputFormat is the format listings are written in
+var outputFormat = "text"
+
+// outputFormats lists the supported values of the -format flag
+var outputFormats = []string{"text", "json", "jsonl", "csv", "tsv", "null"}
+
+// Record is a row of a listing
+type Record struct {
+	ID       int64  `json:"-"`
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Mtime    int64  `json:"mtime"`
+	Checksum string `json:"checksum"`
+	Count    int64  `json:"count,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Status   string `json:"status,omitempty"`
+}
+
+// validFormat reports whether format is a supported output format
+func validFormat(format string) bool {
+	for _, f := range outputFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// scanRecord reads id, filename, filesize, mtime and checksum from rows.
+// Size, mtime and checksum may be NULL, e.g. for deleted files.
+func scanRecord(rows *sql.Rows, basepath string) (Record, error) {
+	var (
+		r        Record
+		filename string
+		filesize sql.NullInt64
+		mtime    sql.NullFloat64 // oddities from a python populated database
+		checksum sql.NullString
+	)
+	err := rows.Scan(&r.ID, &filename, &filesize, &mtime, &checksum)
+	if err != nil {
+		return r, err
+	}
+	r.Path = basepath + filename
+	r.Size = filesize.Int64
+	r.Mtime = int64(mtime.Float64)
+	r.Checksum = checksum.String
+	return r, nil
+}
+
+// queryRecords runs a statement selecting id, filename, filesize, mtime and checksum
+func (db *DB) queryRecords(statement string, args ...interface{}) ([]Record, error) {
+
+	// get basepath
+	basepath, err := db.GetOption("basepath")
+	checkErr(err)
+
+	rows, err := db.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		r, err := scanRecord(rows, basepath)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// writeRecords prints records in the selected output format.
+// Text is rendered line by line with the given function and shown in the pager.
+func writeRecords(records []Record, text func(r Record) string) error {
+	switch outputFormat {
+	case "json":
+		if records == nil {
+			records = []Record{}
+		}
+		out, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+	case "jsonl":
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range records {
+			err := enc.Encode(r)
+			if err != nil {
+				return err
+			}
+		}
+	case "csv", "tsv":
+		w := csv.NewWriter(os.Stdout)
+		if outputFormat == "tsv" {
+			w.Comma = '\t'
+		}
+		// source and status only for listings that have them, e.g. diff
+		extra := false
+		for _, r := range records {
+			if r.Status != "" {
+				extra = true
+				break
+			}
+		}
+		header := []string{"path", "size", "mtime", "checksum", "count"}
+		if extra {
+			header = append(header, "source", "status")
+		}
+		w.Write(header)
+		for _, r := range records {
+			row := []string{r.Path, strconv.FormatInt(r.Size, 10), strconv.FormatInt(r.Mtime, 10), r.Checksum, strconv.FormatInt(r.Count, 10)}
+			if extra {
+				row = append(row, r.Source, r.Status)
+			}
+			w.Write(row)
+		}
+		w.Flush()
+		return w.Error()
+	case "null":
+		var buffer bytes.Buffer
+		for _, r := range records {
+			buffer.WriteString(r.Path)
+			buffer.WriteByte(0)
+		}
+		os.Stdout.Write(buffer.Bytes())
+	default:
+		var buffer bytes.Buffer
+		for _, r := range records {
+			buffer.WriteString(text(r))
+		}
+		pager(buffer.String())
+	}
+	return nil
+}
+
+// formatFlag adds the -format flag to a command
+func formatFlag(flags *flag.FlagSet) *string {
+	return flags.String("format", outputFormat, "output format: "+strings.Join(outputFormats, ", "))
+}
+
+// setFormat selects the output format of listings
+func setFormat(format string) error {
+	if !validFormat(format) {
+		return fmt.Errorf("unknown format %q", format)
+	}
+	outputFormat = format
+	return nil
+}
+
+// listCommand runs a listing from the command line with its own -format flag
+func listCommand(name string, list func(db *DB, args []string) error) func(db *DB, args []string) error {
+	return func(db *DB, args []string) error {
+		flags := flag.NewFlagSet(name, flag.ExitOnError)
+		format := formatFlag(flags)
+		flags.Parse(args)
+		err := setFormat(*format)
+		if err != nil {
+			return err
+		}
+		return list(db, flags.Args())
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// busyTimeout is how long a statement waits for another connection to
+// finish writing before it fails with "database is locked"
+const busyTimeout = time.Minute
+
+// writeCommands are the commands that need the write lock
+var writeCommands = map[string]bool{
+	"repair":      true,
+	"parity":      true,
+	"reconstruct": true,
+	"index":       true,
+	"dedupe":      true,
+	"snapshot":    true,
+}
+
+// path returns the file of the database, empty for in-memory databases
+func (db *DB) path() (string, error) {
+	var seq int
+	var name, path string
+	err := db.QueryRow("PRAGMA database_list").Scan(&seq, &name, &path)
+	return path, err
+}
+
+// errLocked is returned by flock when another process holds the lock
+var errLocked = errors.New("locked by another process")
+
+// flock opens a lock file next to the database and locks it without
+// waiting, see lockFile
+func (db *DB) flock(suffix string) (*os.File, error) {
+	path, err := db.path()
+	if err != nil || path == "" {
+		return nil, err
+	}
+	return lockFile(path + suffix)
+}
+
+// Lock takes the advisory lock for writing to the database, so that long
+// running operations of two processes do not interleave. The lock file
+// tells who holds it. Nested calls of the same process succeed.
+func (db *DB) Lock(operation string) error {
+	return db.lock(operation, true)
+}
+
+// lock takes the lock, with check only if the database matches its manifest
+func (db *DB) lock(operation string, check bool) error {
+	db.lockMutex.Lock()
+	defer db.lockMutex.Unlock()
+	if db.lockCount > 0 {
+		db.lockCount++
+		return nil
+	}
+
+	f, err := db.flock(".lock")
+	if err == errLocked {
+		path, _ := db.path()
+		content, _ := ioutil.ReadFile(path + ".lock")
+		return fmt.Errorf("database busy, %v", describeLock(string(content)))
+	}
+	if err != nil {
+		return err
+	}
+
+	// do not build on a database that was tampered with, see manifest.go.
+	// A lock file that was not emptied tells of a run that died holding it.
+	interrupted := ""
+	if f != nil {
+		content, _ := ioutil.ReadAll(f)
+		if len(strings.TrimSpace(string(content))) > 0 {
+			interrupted = describeLock(string(content))
+		}
+	}
+	if check {
+		err = db.checkManifest(interrupted)
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return err
+	}
+	if f != nil {
+		f.Truncate(0)
+		f.WriteAt([]byte(fmt.Sprintf("%v %v %v\n", os.Getpid(), time.Now().Unix(), operation)), 0)
+	}
+	db.lockFile = f
+	db.lockCount = 1
+	db.lockRecorded = false
+	db.lockConn, db.lockVersion = db.watchChanges()
+	return nil
+}
+
+// describeLock tells who holds a lock from the content of the lock file
+func describeLock(content string) string {
+	fields := strings.SplitN(strings.TrimSpace(content), " ", 3)
+	if len(fields) < 3 {
+		return "locked by another process"
+	}
+	since, _ := strconv.ParseInt(fields[1], 10, 64)
+	return fmt.Sprintf("held by PID %v since %v (%v)", fields[0],
+		time.Unix(since, 0).Format("2006-01-02 15:04:05"), fields[2])
+}
+
+// Unlock releases the lock taken by Lock. A run that did not get to
+// AfterRun, because it returned an error or panicked, still records its
+// changes in a manifest: they were made by checksummer on a database that
+// matched the previous one when it was locked. Only the changes of a
+// process that was killed have to be accepted with manifest -update.
+func (db *DB) Unlock() {
+	db.lockMutex.Lock()
+	defer db.lockMutex.Unlock()
+	db.lockCount--
+	if db.lockCount > 0 {
+		return
+	}
+	if !db.lockRecorded {
+		err := db.WriteManifest(false)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "writing the manifest failed:", err)
+		}
+	}
+	if db.lockConn != nil {
+		db.lockConn.Close()
+		db.lockConn = nil
+	}
+	if db.lockFile == nil {
+		return
+	}
+	db.lockFile.Truncate(0)
+	db.lockFile.Close()
+	db.lockFile = nil
+}
+
+// AfterRun records the new state of the database after a successful run:
+// it writes the manifest and backs up the database
+func (db *DB) AfterRun() {
+	err := db.WriteManifest(false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "writing the manifest failed:", err)
+	} else {
+		db.lockMutex.Lock()
+		db.lockRecorded = true
+		db.lockMutex.Unlock()
+	}
+	db.AutoBackup()
+}
+
+// withLock runs a write operation holding the lock, see finishRun
+func (db *DB) withLock(operation string, run func() error) error {
+	err := db.Lock(operation)
+	if err != nil {
+		return err
+	}
+	return db.finishRun(run)
+}
+
+// finishRun runs a write operation for which the lock was taken and
+// releases it, also when the operation panics. A successful run is
+// recorded with AfterRun, a failed one by Unlock.
+func (db *DB) finishRun(run func() error) error {
+	defer db.Unlock()
+	err := run()
+	if err == nil {
+		db.AfterRun()
+	}
+	return err
+}
+
+// locked wraps a menu action in the write lock
+func (db *DB) locked(operation string, action func()) func() {
+	return func() {
+		err := db.withLock(operation, func() error {
+			action()
+			return nil
+		})
+		if err != nil {
+			fmt.Println(err)
+			readLine("press [Enter] to continue")
+		}
+	}
+}
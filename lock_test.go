@@ -0,0 +1,81 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPanickingRunReleasesLock(t *testing.T) {
+	db := testDB(t, "/a")
+	err := db.WriteManifest(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("the panic did not pass through")
+			}
+		}()
+		db.withLock("test", func() error {
+			_, err := db.Exec("UPDATE files SET checksum_sha256 = 'sum'")
+			checkErr(err)
+			panic("failed")
+		})
+	}()
+
+	// the lock is free and the changes made so far are recorded
+	err = db.withLock("test", func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := lastManifest(t, db); m.Files != 1 {
+		t.Errorf("manifest with %v files", m.Files)
+	}
+}
+
+func TestBackupOnlyAfterChanges(t *testing.T) {
+	db := testDB(t, "/a")
+	dir := t.TempDir()
+	for name, value := range map[string]string{"db_backup_dir": dir, "db_backup_keep": "5"} {
+		err := db.SetOption(name, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups := func() int {
+		found, err := filepath.Glob(filepath.Join(dir, "*.bak"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(found)
+	}
+
+	// the first run records the manifest
+	err := db.withLock("test", func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := backups()
+
+	err = db.withLock("test", func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backups() != first {
+		t.Error("backup after a run that changed nothing")
+	}
+
+	// a change that keeps counts and lengths
+	err = db.withLock("test", func() error {
+		_, err := db.Exec("UPDATE files SET filename = '/b'")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backups() != first+1 {
+		t.Error("no backup after a run that renamed a file")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Which hashes files from outside the database and lists every path with the same content.
+// Hashing is skipped when no file in the database has the same size.
+func (db *DB) Which(paths []string) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("no files given")
+	}
+
+	var records []Record
+	missing := 0
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", path)
+		}
+
+		count, err := db.GetCount(fmt.Sprintf("SELECT count(id) FROM files WHERE filesize = %d AND checksum_sha256 IS NOT NULL", fi.Size()))
+		checkErr(err)
+		if count == 0 {
+			missing++
+			records = append(records, Record{Source: path})
+			continue
+		}
+
+		hash, err := HashFile(path)
+		if err != nil {
+			return err
+		}
+		found, err := db.queryRecords(`SELECT id, filename, filesize, mtime, checksum_sha256
+                                        FROM files
+                                        WHERE checksum_sha256 = ?
+                                        ORDER BY filename`, hash)
+		if err != nil {
+			return err
+		}
+		if len(found) == 0 {
+			missing++
+			records = append(records, Record{Source: path, Checksum: hash})
+			continue
+		}
+		for _, r := range found {
+			r.Source = path
+			records = append(records, r)
+		}
+	}
+
+	// files that are not in the database only show up in the text output
+	if outputFormat != "text" {
+		var matches []Record
+		for _, r := range records {
+			if r.Path != "" {
+				matches = append(matches, r)
+			}
+		}
+		records = matches
+	}
+
+	err := writeRecords(records, func(r Record) string {
+		if r.Path == "" {
+			return fmt.Sprintf("%v: not in database\n", r.Source)
+		}
+		return fmt.Sprintf("%v: %v\n", r.Source, r.Path)
+	})
+	if err != nil {
+		return err
+	}
+	if missing > 0 {
+		return fmt.Errorf("%v of %v files not in database", missing, len(paths))
+	}
+	return nil
+}
+
+// minLookupPrefix is the shortest checksum prefix Lookup accepts, shorter
+// ones match a good part of the database
+const minLookupPrefix = 4
+
+// Lookup lists every path whose checksum starts with the given hash
+func (db *DB) Lookup(hashes []string) error {
+	if len(hashes) == 0 {
+		return fmt.Errorf("no checksums given")
+	}
+
+	var records []Record
+	for _, hash := range hashes {
+		hash = strings.ToLower(strings.TrimSpace(hash))
+		if len(hash) < minLookupPrefix || len(hash) > sha256.Size*2 || strings.Trim(hash, "0123456789abcdef") != "" {
+			return fmt.Errorf("invalid checksum %q, give at least %v hex digits", hash, minLookupPrefix)
+		}
+
+		// a range instead of LIKE, so that the checksum index is used
+		found, err := db.queryRecords(`SELECT id, filename, filesize, mtime, checksum_sha256
+                                        FROM files
+                                        WHERE checksum_sha256 >= ? AND checksum_sha256 < ?
+                                        ORDER BY filename`, hash, hash+"\x7f")
+		if err != nil {
+			return err
+		}
+		records = append(records, found...)
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("no file with checksum %v", strings.Join(hashes, ", "))
+	}
+
+	return writeRecords(records, func(r Record) string {
+		return fmt.Sprintf("%v  %8v    %v\n", r.Checksum, ByteSize(r.Size), r.Path)
+	})
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLookupPrefixes(t *testing.T) {
+	db := testDB(t, "/a")
+	_, err := db.Exec("UPDATE files SET checksum_sha256 = ?", strings.Repeat("3f2a", 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hash := range []string{"", " ", "3f2", "3f2x", strings.Repeat("3f2a", 17)} {
+		if err := db.Lookup([]string{hash}); err == nil {
+			t.Errorf("no error for %q", hash)
+		}
+	}
+	for _, hash := range []string{"3f2a", " 3F2A ", strings.Repeat("3f2a", 16)} {
+		if err := db.Lookup([]string{hash}); err != nil {
+			t.Errorf("%q: %v", hash, err)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// durabilityModes are the synchronous settings of the durability modes:
+// safe syncs every commit, balanced only at checkpoints of the write-ahead
+// log, which can lose the last commits but not corrupt the database on
+// power loss, and fast never syncs
+var durabilityModes = map[string]string{
+	"safe":     "FULL",
+	"balanced": "NORMAL",
+	"fast":     "OFF",
+}
+
+const (
+	// defaultDurability is used until another mode is chosen
+	defaultDurability = "balanced"
+	// journalSizeLimit is the size the write-ahead log is truncated to
+	journalSizeLimit = 64 << 20
+	// defaultBackupKeep is how many backups are kept if not set
+	defaultBackupKeep = 3
+)
+
+// dbOptions are the database settings, stored as options prefixed with db_
+var dbOptions = []struct {
+	name string
+	help string
+}{
+	{"durability", "safe, balanced or fast (default balanced)"},
+	{"backup_keep", "backups kept after each successful run, 0 disables them (default 3)"},
+	{"backup_dir", "directory of the backups (default next to the database)"},
+}
+
+func init() {
+	sql.Register("checksummer", &sqlite3.SQLiteDriver{ConnectHook: configureConnection})
+}
+
+// configureConnection applies the durability mode of the database to every
+// new connection, as the synchronous setting is not stored in the file
+func configureConnection(conn *sqlite3.SQLiteConn) error {
+	mode := defaultDurability
+	rows, err := conn.Query("SELECT o_value FROM options WHERE o_name = 'db_durability'", nil)
+	if err == nil {
+		value := make([]driver.Value, 1)
+		if rows.Next(value) == nil {
+			if m, ok := value[0].(string); ok && durabilityModes[m] != "" {
+				mode = m
+			}
+		}
+		rows.Close()
+	}
+
+	_, err = conn.Exec("PRAGMA synchronous="+durabilityModes[mode], nil)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(fmt.Sprintf("PRAGMA journal_size_limit=%d", journalSizeLimit), nil)
+	return err
+}
+
+// dbOption returns a database setting, empty if not set
+func (db *DB) dbOption(name string) string {
+	return db.optionalOption("db_" + name)
+}
+
+// CheckDatabase runs quick_check, or the slower integrity_check that also
+// verifies the indexes, and prints the problems found
+func (db *DB) CheckDatabase(full bool) error {
+	pragma := "quick_check"
+	if full {
+		pragma = "integrity_check"
+	}
+	rows, err := db.Query("PRAGMA " + pragma)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		err = rows.Scan(&line)
+		if err != nil {
+			return err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		return fmt.Errorf("%v found %v problems, restore a backup", pragma, len(problems))
+	}
+	fmt.Printf("%v: ok\n", pragma)
+	return nil
+}
+
+// rawConn runs fn with the driver connection of a pooled connection
+func rawConn(db *sql.DB, fn func(conn *sqlite3.SQLiteConn) error) error {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Raw(func(driverConn interface{}) error {
+		return fn(driverConn.(*sqlite3.SQLiteConn))
+	})
+}
+
+// Backup copies the database with the SQLite online backup API, which
+// gives a consistent copy while other connections keep writing. The copy
+// is checked and then renamed into place, and the oldest backups beyond
+// keep are removed.
+func (db *DB) Backup(dir string, keep int) (string, error) {
+	path, err := db.path()
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		return "", fmt.Errorf("in-memory databases cannot be backed up")
+	}
+	if dir == "" {
+		dir = filepath.Dir(path)
+	}
+	base := filepath.Base(path)
+	stamp := time.Now().Format("20060102-150405")
+	tmp := filepath.Join(dir, base+"."+stamp+".bak.tmp")
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+
+	dest, err := sql.Open("sqlite3", tmp)
+	if err != nil {
+		return "", err
+	}
+	defer dest.Close()
+	err = rawConn(dest, func(destConn *sqlite3.SQLiteConn) error {
+		return rawConn(db.DB, func(srcConn *sqlite3.SQLiteConn) error {
+			backup, err := destConn.Backup("main", srcConn, "main")
+			if err != nil {
+				return err
+			}
+			done, err := backup.Step(-1)
+			if err == nil && !done {
+				err = fmt.Errorf("backup did not finish, database busy")
+			}
+			if ferr := backup.Finish(); err == nil {
+				err = ferr
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+	var result string
+	err = dest.QueryRow("PRAGMA quick_check").Scan(&result)
+	if err == nil && result != "ok" {
+		err = fmt.Errorf("backup failed quick_check: %v", result)
+	}
+	if err == nil {
+		// the copy is self-contained, without a write-ahead log next to it
+		_, err = dest.Exec("PRAGMA journal_mode=DELETE")
+	}
+	if err != nil {
+		return "", err
+	}
+	dest.Close()
+
+	// linking fails instead of replacing a backup made in the same second
+	target := filepath.Join(dir, base+"."+stamp+".bak")
+	for n := 2; ; n++ {
+		err = os.Link(tmp, target)
+		if !os.IsExist(err) {
+			break
+		}
+		target = filepath.Join(dir, fmt.Sprintf("%v.%v-%d.bak", base, stamp, n))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// rotate, oldest first
+	backups, err := filepath.Glob(filepath.Join(dir, base+".*.bak"))
+	if err != nil {
+		return target, err
+	}
+	modified := map[string]time.Time{}
+	for _, b := range backups {
+		if fi, err := os.Stat(b); err == nil {
+			modified[b] = fi.ModTime()
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if !modified[backups[i]].Equal(modified[backups[j]]) {
+			return modified[backups[i]].Before(modified[backups[j]])
+		}
+		return len(backups[i]) < len(backups[j]) || len(backups[i]) == len(backups[j]) && backups[i] < backups[j]
+	})
+	for i := 0; i < len(backups)-keep; i++ {
+		err = os.Remove(backups[i])
+		if err != nil {
+			return target, err
+		}
+	}
+	return target, nil
+}
+
+// watchChanges takes a connection out of the pool to tell later whether
+// data was changed: its data_version grows with every commit of another
+// connection, so that runs that changed nothing, like a cancelled dedupe or
+// a dry run, are told apart
+func (db *DB) watchChanges() (*sql.Conn, int64) {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, 0
+	}
+	version, err := dataVersion(conn)
+	if err != nil {
+		conn.Close()
+		return nil, 0
+	}
+	return conn, version
+}
+
+// dataVersion returns the data_version of a connection
+func dataVersion(conn *sql.Conn) (int64, error) {
+	var version int64
+	err := conn.QueryRowContext(context.Background(), "PRAGMA data_version").Scan(&version)
+	return version, err
+}
+
+// AutoBackup backs up the database after a successful run that changed
+// data, unless disabled. A failed backup is reported but does not fail the
+// run.
+func (db *DB) AutoBackup() {
+	db.lockMutex.Lock()
+	unchanged := false
+	if db.lockConn != nil {
+		version, err := dataVersion(db.lockConn)
+		unchanged = err == nil && version == db.lockVersion
+	}
+	db.lockMutex.Unlock()
+	if unchanged {
+		return
+	}
+	keep, err := strconv.Atoi(db.dbOption("backup_keep"))
+	if err != nil {
+		keep = defaultBackupKeep
+	}
+	if keep <= 0 {
+		return
+	}
+	path, err := db.Backup(db.dbOption("backup_dir"), keep)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "database backup failed:", err)
+		return
+	}
+	fmt.Println("database backed up to", path)
+}
+
+func cmdDatabase(db *DB, args []string) error {
+	var action string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("db", flag.ExitOnError)
+	list := flags.Bool("list", false, "show the database settings")
+	set := flags.String("set", "", "change a setting, e.g. durability=safe")
+	full := flags.Bool("full", false, "check: run the thorough integrity_check instead of quick_check")
+	flags.Parse(args)
+
+	switch {
+	case *list:
+		for _, o := range dbOptions {
+			fmt.Printf("%-14v %-14v %v\n", o.name, db.dbOption(o.name), o.help)
+		}
+		return nil
+	case *set != "":
+		parts := strings.SplitN(*set, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("use -set NAME=VALUE")
+		}
+		switch parts[0] {
+		case "durability":
+			if durabilityModes[parts[1]] == "" {
+				return fmt.Errorf("durability is safe, balanced or fast")
+			}
+		case "backup_keep":
+			if _, err := strconv.Atoi(parts[1]); err != nil {
+				return fmt.Errorf("backup_keep is a number")
+			}
+		case "backup_dir":
+		default:
+			return fmt.Errorf("unknown setting %q, see db -list", parts[0])
+		}
+		return db.SetOption("db_"+parts[0], parts[1])
+	}
+
+	switch action {
+	case "check":
+		return db.CheckDatabase(*full)
+	case "backup":
+		keep, err := strconv.Atoi(db.dbOption("backup_keep"))
+		if err != nil || keep <= 0 {
+			keep = defaultBackupKeep
+		}
+		path, err := db.Backup(db.dbOption("backup_dir"), keep)
+		if err != nil {
+			return err
+		}
+		fmt.Println("database backed up to", path)
+		return nil
+	}
+	return fmt.Errorf("use db check, db backup, db -list or db -set NAME=VALUE")
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// merkle computes the root of a Merkle tree over leaves added in order,
+// keeping only one pending node per level
+type merkle struct {
+	levels [][]byte // pending node per level, nil if none
+	count  int
+}
+
+// add adds a leaf; leaves and inner nodes are hashed with different
+// prefixes, so a leaf can never pass for an inner node
+func (m *merkle) add(data []byte) {
+	h := sha256.Sum256(append([]byte{0}, data...))
+	node := h[:]
+	m.count++
+	for level := 0; ; level++ {
+		if level == len(m.levels) {
+			m.levels = append(m.levels, nil)
+		}
+		if m.levels[level] == nil {
+			m.levels[level] = node
+			return
+		}
+		node = hashNodes(m.levels[level], node)
+		m.levels[level] = nil
+	}
+}
+
+// root returns the hex root, nodes without a sibling are carried up
+func (m *merkle) root() string {
+	var node []byte
+	for _, pending := range m.levels {
+		switch {
+		case pending == nil:
+		case node == nil:
+			node = pending
+		default:
+			node = hashNodes(pending, node)
+		}
+	}
+	if node == nil {
+		empty := sha256.Sum256(nil)
+		node = empty[:]
+	}
+	return hex.EncodeToString(node)
+}
+
+func hashNodes(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// Manifest is the integrity digest of the files table after a run
+type Manifest struct {
+	ID        int64
+	Created   int64
+	Files     int
+	Root      string
+	Previous  string // digest of the manifest before, chaining them
+	Digest    string
+	PublicKey string
+	Signature string
+}
+
+// digest hashes the manifest together with its predecessor
+func (m Manifest) digest() string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%v\n%v\n%v\n%v", m.Previous, m.Created, m.Files, m.Root)))
+	return hex.EncodeToString(h[:])
+}
+
+// The manifest root has two levels: every directory has a Merkle root over
+// the name, size and checksum of the hashed files directly in it, and the
+// manifest root is the Merkle root over the directories and their roots.
+// manifest_dirs keeps the directory roots of the latest manifest. Triggers
+// note the directory of every changed file in manifest_dirty, so that the
+// check before a run and the manifest after it only rehash those
+// directories; manifest verifies the whole table.
+
+// dirOf returns the SQL expression for the directory of a filename column,
+// with a trailing slash: rtrim strips all but slashes from the end
+func dirOf(column string) string {
+	return "rtrim(" + column + ", replace(" + column + ", '/', ''))"
+}
+
+// dirRoot is the Merkle root of the files of a directory
+type dirRoot struct {
+	files int
+	root  string
+}
+
+// queryer is a *sql.DB or a *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// hashDirs computes the roots of the given directories, of all of them if
+// dirs is nil. Directories without hashed files are left out.
+func hashDirs(q queryer, dirs []string) (map[string]dirRoot, error) {
+	roots := map[string]dirRoot{}
+	var trees map[string]*merkle
+	add := func(rows *sql.Rows) error {
+		defer rows.Close()
+		for rows.Next() {
+			var dir, filename, checksum string
+			var size int64
+			err := rows.Scan(&dir, &filename, &size, &checksum)
+			if err != nil {
+				return err
+			}
+			if trees[dir] == nil {
+				trees[dir] = &merkle{}
+			}
+			trees[dir].add([]byte(filename + "\x00" + strconv.FormatInt(size, 10) + "\x00" + checksum))
+		}
+		return rows.Err()
+	}
+
+	trees = map[string]*merkle{}
+	query := `SELECT ` + dirOf("filename") + `, filename, ifnull(filesize, 0), checksum_sha256
+              FROM files
+              WHERE checksum_sha256 IS NOT NULL`
+	if dirs == nil {
+		rows, err := q.Query(query + " ORDER BY " + dirOf("filename") + ", filename")
+		if err != nil {
+			return nil, err
+		}
+		err = add(rows)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, dir := range dirs {
+		rows, err := q.Query(query+" AND "+dirOf("filename")+" = ? ORDER BY filename", dir)
+		if err != nil {
+			return nil, err
+		}
+		err = add(rows)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for dir, tree := range trees {
+		roots[dir] = dirRoot{files: tree.count, root: tree.root()}
+	}
+	return roots, nil
+}
+
+// manifestRoot combines the directory roots into the manifest root
+func manifestRoot(dirs map[string]dirRoot) (root string, files int) {
+	var names []string
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+	sort.Strings(names)
+	var all merkle
+	for _, dir := range names {
+		all.add([]byte(dir + "\x00" + strconv.Itoa(dirs[dir].files) + "\x00" + dirs[dir].root))
+		files += dirs[dir].files
+	}
+	return all.root(), files
+}
+
+// storedDirs returns the directory roots of the latest manifest and the
+// directories changed since
+func storedDirs(q queryer) (map[string]dirRoot, []string, error) {
+	rows, err := q.Query("SELECT dir, files, root FROM manifest_dirs")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	dirs := map[string]dirRoot{}
+	for rows.Next() {
+		var dir string
+		var d dirRoot
+		err = rows.Scan(&dir, &d.files, &d.root)
+		if err != nil {
+			return nil, nil, err
+		}
+		dirs[dir] = d
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, nil, err
+	}
+	rows.Close()
+
+	rows, err = q.Query("SELECT dir FROM manifest_dirty ORDER BY dir")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var dirty []string
+	for rows.Next() {
+		var dir string
+		err = rows.Scan(&dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		dirty = append(dirty, dir)
+	}
+	return dirs, dirty, rows.Err()
+}
+
+// changedDirs lists the directories whose roots differ, up to ten of them
+func changedDirs(before map[string]dirRoot, after map[string]dirRoot) string {
+	var changed []string
+	for dir, d := range before {
+		if after[dir] != d {
+			changed = append(changed, dir)
+		}
+	}
+	for dir := range after {
+		if _, ok := before[dir]; !ok {
+			changed = append(changed, dir)
+		}
+	}
+	sort.Strings(changed)
+	if len(changed) > 10 {
+		return strings.Join(changed[:10], ", ") + fmt.Sprintf(" and %v more", len(changed)-10)
+	}
+	return strings.Join(changed, ", ")
+}
+
+// Manifests returns the chain of manifests, oldest first
+func (db *DB) Manifests() ([]Manifest, error) {
+	rows, err := db.Query(`SELECT id, created, files, root, previous, digest, ifnull(public_key, ''), ifnull(signature, '')
+                           FROM manifests
+                           ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var manifests []Manifest
+	for rows.Next() {
+		var m Manifest
+		err = rows.Scan(&m.ID, &m.Created, &m.Files, &m.Root, &m.Previous, &m.Digest, &m.PublicKey, &m.Signature)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, m)
+	}
+	return manifests, rows.Err()
+}
+
+// readKeyFile reads a hex encoded Ed25519 key from a file
+func readKeyFile(path string, size int) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(key) != size {
+		return nil, fmt.Errorf("%v is not an Ed25519 key", path)
+	}
+	return key, nil
+}
+
+// GenerateKey writes a new Ed25519 key pair to path and path.pub and
+// signs the manifests with it from now on
+func (db *DB) GenerateKey(path string) error {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path, []byte(hex.EncodeToString(private)+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path+".pub", []byte(hex.EncodeToString(public)+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("manifests are signed with %v from now on, keep %v.pub elsewhere to verify them\n", path, path)
+	return db.SetOption("manifest_key", path)
+}
+
+// WriteManifest appends a manifest of the current state of the files
+// table to the chain, unless it did not change since the last one. Only
+// the directories changed since are rehashed, or all of them with full.
+func (db *DB) WriteManifest(full bool) error {
+	manifests, err := db.Manifests()
+	if err != nil {
+		return err
+	}
+
+	m := Manifest{Created: time.Now().Unix()}
+	var private ed25519.PrivateKey
+	if path := db.optionalOption("manifest_key"); path != "" {
+		key, err := readKeyFile(path, ed25519.PrivateKeySize)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "manifest not signed:", err)
+		} else {
+			private = ed25519.PrivateKey(key)
+			m.PublicKey = hex.EncodeToString(private.Public().(ed25519.PublicKey))
+		}
+	}
+	var last *Manifest
+	if len(manifests) > 0 {
+		last = &manifests[len(manifests)-1]
+		m.Previous = last.Digest
+	}
+	full = full || last == nil
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	dirs, dirty, err := storedDirs(tx)
+	if err != nil {
+		return err
+	}
+	if !full && len(dirty) == 0 && last.PublicKey == m.PublicKey {
+		return nil
+	}
+	if full {
+		dirs, err = hashDirs(tx, nil)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM manifest_dirs")
+		if err != nil {
+			return err
+		}
+		dirty = nil
+		for dir := range dirs {
+			dirty = append(dirty, dir)
+		}
+	} else {
+		dirs, err = rehashDirs(tx, dirs, dirty)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range dirty {
+		_, err = tx.Exec("DELETE FROM manifest_dirs WHERE dir = ?", dir)
+		if err != nil {
+			return err
+		}
+		if d, ok := dirs[dir]; ok {
+			_, err = tx.Exec("INSERT INTO manifest_dirs(dir, files, root) VALUES(?, ?, ?)", dir, d.files, d.root)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err = tx.Exec("DELETE FROM manifest_dirty")
+	if err != nil {
+		return err
+	}
+
+	m.Root, m.Files = manifestRoot(dirs)
+	if last != nil && last.Root == m.Root && last.PublicKey == m.PublicKey {
+		// changed back, or only the directory roots were rebuilt
+		return tx.Commit()
+	}
+	m.Digest = m.digest()
+	if private != nil {
+		digest, _ := hex.DecodeString(m.Digest)
+		m.Signature = hex.EncodeToString(ed25519.Sign(private, digest))
+	}
+	_, err = tx.Exec(`INSERT INTO manifests(created, files, root, previous, digest, public_key, signature)
+                      VALUES(?, ?, ?, ?, ?, ?, ?)`, m.Created, m.Files, m.Root, m.Previous, m.Digest, m.PublicKey, m.Signature)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// rehashDirs returns the directory roots with the dirty directories rehashed
+func rehashDirs(q queryer, stored map[string]dirRoot, dirty []string) (map[string]dirRoot, error) {
+	changed, err := hashDirs(q, dirty)
+	if err != nil {
+		return nil, err
+	}
+	dirs := make(map[string]dirRoot, len(stored))
+	for dir, d := range stored {
+		dirs[dir] = d
+	}
+	for _, dir := range dirty {
+		if d, ok := changed[dir]; ok {
+			dirs[dir] = d
+		} else {
+			delete(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
+// verifyChain checks the chain of manifests and their signatures. Signatures
+// are checked against publicKey if given, otherwise only against the key
+// stored with them, which detects damage but not forgery.
+func verifyChain(manifests []Manifest, publicKey []byte) error {
+	// with publicKey, every manifest from the first one signed with it on
+	// must be signed with it, the earlier ones may predate the key
+	previous := ""
+	trusted := false
+	for _, m := range manifests {
+		if m.Previous != previous || m.digest() != m.Digest {
+			return fmt.Errorf("manifest %v was altered or the chain is broken", m.ID)
+		}
+		previous = m.Digest
+
+		key := publicKey
+		if key == nil && m.Signature != "" {
+			key, _ = hex.DecodeString(m.PublicKey)
+		}
+		if key == nil || publicKey != nil && !trusted && m.PublicKey != hex.EncodeToString(publicKey) {
+			continue
+		}
+		trusted = true
+		signature, _ := hex.DecodeString(m.Signature)
+		digest, _ := hex.DecodeString(m.Digest)
+		if len(key) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(key), digest, signature) {
+			return fmt.Errorf("manifest %v is not signed by the key", m.ID)
+		}
+	}
+
+	if publicKey != nil && !trusted {
+		return fmt.Errorf("no manifest is signed by the key")
+	}
+	return nil
+}
+
+// changedSince is the error for files that differ from the latest manifest
+func changedSince(last Manifest, files int, before map[string]dirRoot, after map[string]dirRoot) error {
+	return fmt.Errorf("the checksums changed since manifest %v of %v (%v files then, %v now), below: %v",
+		last.ID, time.Unix(last.Created, 0).Format("2006-01-02 15:04:05"), last.Files, files, changedDirs(before, after))
+}
+
+// VerifyManifest checks the chain of manifests, see verifyChain, and
+// whether the whole files table still matches the latest one
+func (db *DB) VerifyManifest(publicKey []byte, quiet bool) error {
+	manifests, err := db.Manifests()
+	if err != nil {
+		return err
+	}
+	if len(manifests) == 0 {
+		if !quiet {
+			fmt.Println("no manifest yet, one is written after the next run")
+		}
+		return nil
+	}
+	err = verifyChain(manifests, publicKey)
+	if err != nil {
+		return err
+	}
+
+	last := manifests[len(manifests)-1]
+	dirs, err := hashDirs(db, nil)
+	if err != nil {
+		return err
+	}
+	root, files := manifestRoot(dirs)
+	if root != last.Root {
+		stored, _, err := storedDirs(db)
+		if err != nil {
+			return err
+		}
+		return changedSince(last, files, stored, dirs)
+	}
+
+	if !quiet {
+		signed := "unsigned"
+		switch {
+		case last.Signature != "" && publicKey != nil:
+			signed = "signed with the given key"
+		case last.Signature != "":
+			signed = "signed, use -pubkey to check the signer"
+		}
+		fmt.Printf("ok: %v files match manifest %v of %v, %v\n", files, last.ID,
+			time.Unix(last.Created, 0).Format("2006-01-02 15:04:05"), signed)
+	}
+	return nil
+}
+
+// checkManifest is run before writing: the database must match its
+// manifest. It checks the chain and rehashes only the directories changed
+// since the latest manifest, which are none after a completed run.
+// Changes are only accepted with manifest -update, also those of an
+// interrupted run, which is described by interrupted if there was one.
+func (db *DB) checkManifest(interrupted string) error {
+	err := db.quickVerifyManifest()
+	if err == nil {
+		return nil
+	}
+	if interrupted != "" {
+		return fmt.Errorf("%v; the run %v was interrupted, or the database was altered since, "+
+			"check with manifest, restore a backup or accept the changes with manifest -update", err, interrupted)
+	}
+	return fmt.Errorf("%v; the database was altered outside checksummer or is damaged, "+
+		"check with manifest, restore a backup or accept the changes with manifest -update", err)
+}
+
+// quickVerifyManifest checks the chain, the stored directory roots against
+// the latest manifest and the directories changed since
+func (db *DB) quickVerifyManifest() error {
+	manifests, err := db.Manifests()
+	if err != nil || len(manifests) == 0 {
+		return err
+	}
+	err = verifyChain(manifests, nil)
+	if err != nil {
+		return err
+	}
+
+	last := manifests[len(manifests)-1]
+	stored, dirty, err := storedDirs(db)
+	if err != nil {
+		return err
+	}
+	if root, _ := manifestRoot(stored); root != last.Root {
+		return fmt.Errorf("the directory roots do not match manifest %v", last.ID)
+	}
+	if len(dirty) == 0 {
+		return nil
+	}
+	dirs, err := rehashDirs(db, stored, dirty)
+	if err != nil {
+		return err
+	}
+	root, files := manifestRoot(dirs)
+	if root != last.Root {
+		return changedSince(last, files, stored, dirs)
+	}
+	return nil
+}
+
+func cmdManifest(db *DB, args []string) error {
+	flags := flag.NewFlagSet("manifest", flag.ExitOnError)
+	update := flags.Bool("update", false, "accept the current state and write a new manifest")
+	list := flags.Bool("list", false, "list the manifests")
+	keygen := flags.String("keygen", "", "generate a key pair in this file and sign the manifests with it")
+	pubkey := flags.String("pubkey", "", "verify the signatures with the public key in this file")
+	flags.Parse(args)
+
+	switch {
+	case *keygen != "":
+		// signing must not accept changes on the way
+		err := db.VerifyManifest(nil, true)
+		if err != nil {
+			return err
+		}
+		return db.withLock("manifest -keygen", func() error {
+			return db.GenerateKey(*keygen)
+		})
+	case *update:
+		// accepting changes, the database need not match
+		err := db.lock("manifest -update", false)
+		if err != nil {
+			return err
+		}
+		defer db.Unlock()
+		return db.WriteManifest(true)
+	case *list:
+		manifests, err := db.Manifests()
+		if err != nil {
+			return err
+		}
+		for _, m := range manifests {
+			signed := ""
+			if m.Signature != "" {
+				signed = "signed by " + m.PublicKey[:16]
+			}
+			fmt.Printf("%5v  %v  %10v files  %v  %v\n", m.ID, time.Unix(m.Created, 0).Format("2006-01-02 15:04:05"),
+				thousandsSeparator(m.Files), m.Root[:16], signed)
+		}
+		return nil
+	}
+
+	var key []byte
+	if *pubkey != "" {
+		var err error
+		key, err = readKeyFile(*pubkey, ed25519.PublicKeySize)
+		if err != nil {
+			return err
+		}
+	}
+	return db.VerifyManifest(key, false)
+}
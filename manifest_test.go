@@ -0,0 +1,84 @@
+package main
+
+import "testing"
+
+// lastManifest returns the latest manifest
+func lastManifest(t *testing.T, db *DB) Manifest {
+	manifests, err := db.Manifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) == 0 {
+		t.Fatal("no manifest")
+	}
+	return manifests[len(manifests)-1]
+}
+
+func TestManifestIncremental(t *testing.T) {
+	db := testDB(t, "/a", "/d/b", "/d/e/c", "/d/e/f")
+	_, err := db.Exec("UPDATE files SET checksum_sha256 = 'sum' || id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.WriteManifest(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := lastManifest(t, db); m.Files != 4 {
+		t.Errorf("first manifest has %v files", m.Files)
+	}
+
+	for _, statement := range []string{
+		"UPDATE files SET checksum_sha256 = 'other' WHERE filename = '/d/b'",
+		"UPDATE files SET filename = '/g/c' WHERE filename = '/d/e/c'",
+		"DELETE FROM files WHERE filename = '/d/e/f'",
+		"INSERT INTO files(filename, filesize, checksum_sha256) VALUES('/h', 1, 'new')",
+	} {
+		_, err = db.Exec(statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the changes are found before the next run
+	err = db.checkManifest("")
+	if err == nil {
+		t.Fatal("no error for changed files")
+	}
+	err = db.VerifyManifest(nil, true)
+	if err == nil {
+		t.Fatal("no error for changed files in the full check")
+	}
+
+	// rehashing the changed directories gives the root of the whole table
+	err = db.WriteManifest(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := hashDirs(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, files := manifestRoot(dirs)
+	m := lastManifest(t, db)
+	if m.Root != root || m.Files != files || files != 4 {
+		t.Errorf("manifest %v with %v files, the table %v with %v", m.Root, m.Files, root, files)
+	}
+	err = db.checkManifest("")
+	if err != nil {
+		t.Error(err)
+	}
+	err = db.VerifyManifest(nil, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// nothing changed, no new manifest
+	err = db.WriteManifest(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastManifest(t, db).ID != m.ID {
+		t.Error("new manifest without changes")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// metric is a gauge in the Prometheus text format
+type metric struct {
+	name string
+	help string
+}
+
+var metrics = []metric{
+	{"checksummer_files", "Files found in the root."},
+	{"checksummer_bytes", "Bytes of the files found in the root."},
+	{"checksummer_files_hashed", "Files with a checksum."},
+	{"checksummer_files_verified", "Files whose checksum matched at the last check."},
+	{"checksummer_files_changed", "Files whose checksum did not match, possibly corrupt."},
+	{"checksummer_files_missing", "Files in the database that were not found on disk."},
+	{"checksummer_read_errors", "Files that could not be read at the last check."},
+	{"checksummer_last_verify_timestamp_seconds", "Unix time the last reindex & check finished, 0 if never."},
+	{"checksummer_last_verify_duration_seconds", "Duration of the last reindex & check."},
+}
+
+// Metrics returns the values of all metrics of this database, in the order of metrics
+func (db *DB) Metrics() ([]float64, error) {
+	var found, bytes, hashed, verified, changed, missing float64
+	err := db.QueryRow(`SELECT ifnull(sum(file_found = '1'), 0),
+                               ifnull(sum(CASE WHEN file_found = '1' THEN filesize ELSE 0 END), 0),
+                               ifnull(sum(file_found = '1' AND checksum_sha256 IS NOT NULL), 0),
+                               ifnull(sum(file_found = '1' AND checksum_ok = 1), 0),
+                               ifnull(sum(checksum_ok = '0'), 0),
+                               ifnull(sum(file_found = '0'), 0)
+                        FROM files`).Scan(&found, &bytes, &hashed, &verified, &changed, &missing)
+	if err != nil {
+		return nil, err
+	}
+
+	// not set until the first reindex & check
+	option := func(name string) float64 {
+		value, err := db.GetOption(name)
+		if err != nil {
+			return 0
+		}
+		f, _ := strconv.ParseFloat(value, 64)
+		return f
+	}
+
+	return []float64{found, bytes, hashed, verified, changed, missing,
+		option("last_verify_read_errors"), option("last_verify"), option("last_verify_duration")}, nil
+}
+
+// writeMetrics renders the metrics of all databases, labelled with their basepath
+func writeMetrics(dbs []*DB) ([]byte, error) {
+	values := make([][]float64, len(dbs))
+	roots := make([]string, len(dbs))
+	for i, db := range dbs {
+		var err error
+		values[i], err = db.Metrics()
+		if err != nil {
+			return nil, err
+		}
+		roots[i], err = db.GetOption("basepath")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	var buffer bytes.Buffer
+	for m, metric := range metrics {
+		buffer.WriteString(fmt.Sprintf("# HELP %v %v\n# TYPE %v gauge\n", metric.name, metric.help, metric.name))
+		for i := range dbs {
+			buffer.WriteString(fmt.Sprintf("%v{root=\"%v\"} %v\n", metric.name, escape.Replace(roots[i]),
+				strconv.FormatFloat(values[i][m], 'f', -1, 64)))
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// metricsHandler serves the metrics for Prometheus to scrape
+func metricsHandler(dbs []*DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		out, err := writeMetrics(dbs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(out)
+	}
+}
+
+// writeTextfile writes the metrics for the node_exporter textfile collector.
+// The file is replaced atomically so that it is never read half written.
+func writeTextfile(dbs []*DB, path string) error {
+	out, err := writeMetrics(dbs)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".checksummer-metrics")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(out)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func cmdMetrics(db *DB, args []string) error {
+	flags := flag.NewFlagSet("metrics", flag.ExitOnError)
+	listen := flags.String("listen", "", "serve /metrics on this address, e.g. :9164")
+	textfile := flags.String("textfile", "", "write the metrics to this file for the node_exporter textfile collector")
+	flags.Parse(args)
+
+	// further databases are reported as roots of their own
+	dbs := []*DB{db}
+	for _, path := range flags.Args() {
+		_, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		other, err := Open(path)
+		if err != nil {
+			return err
+		}
+		err = other.Init()
+		if err != nil {
+			return err
+		}
+		dbs = append(dbs, other)
+	}
+
+	switch {
+	case *textfile != "":
+		return writeTextfile(dbs, *textfile)
+	case *listen != "":
+		http.Handle("/metrics", metricsHandler(dbs))
+		fmt.Printf("serving metrics on http://%v/metrics\n", *listen)
+		return http.ListenAndServe(*listen, nil)
+	}
+	out, err := writeMetrics(dbs)
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(out)
+	return nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notifyListLimit is how many changed and missing files a notification lists
+const notifyListLimit = 100
+
+// notifyOptions are the settings of the notifiers, stored as options prefixed with notify_
+var notifyOptions = []struct {
+	name string
+	help string
+}{
+	{"webhook", "URL the summary is POSTed to as JSON"},
+	{"command", "shell command run with the summary on stdin"},
+	{"smtp", "mail server as host:port"},
+	{"smtp_from", "sender address"},
+	{"smtp_to", "recipients, separated by commas"},
+	{"smtp_user", "user for SMTP authentication, if needed"},
+	{"smtp_password", "password for SMTP authentication, stored in plaintext in the database and its backups"},
+	{"changed", "notify when at least this many files changed, 0 to ignore (default 1)"},
+	{"missing", "notify when at least this many files are missing, 0 to ignore (default 1)"},
+	{"read_errors", "notify when at least this many files could not be read, 0 to ignore (default 1)"},
+}
+
+// Summary is the result of a run as sent by the notifiers. Missing only
+// counts the files missing since the previous run.
+type Summary struct {
+	Root         string   `json:"root"`
+	Finished     int64    `json:"finished"`
+	Files        int      `json:"files"`
+	Changed      int      `json:"changed"`
+	Missing      int      `json:"missing"`
+	MissingTotal int      `json:"missing_total"`
+	ReadErrors   int      `json:"read_errors"`
+	ChangedFiles []string `json:"changed_files"`
+	MissingFiles []string `json:"missing_files"`
+}
+
+// Text renders the summary for email and command hooks
+func (s Summary) Text() string {
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("checksummer report for %v\n\n", s.Root))
+	buffer.WriteString(fmt.Sprintf("files:       %v\n", s.Files))
+	buffer.WriteString(fmt.Sprintf("changed:     %v\n", s.Changed))
+	buffer.WriteString(fmt.Sprintf("missing:     %v new, %v in total\n", s.Missing, s.MissingTotal))
+	buffer.WriteString(fmt.Sprintf("read errors: %v\n", s.ReadErrors))
+	if len(s.ChangedFiles) > 0 {
+		buffer.WriteString("\nchanged files:\n")
+		for _, path := range s.ChangedFiles {
+			buffer.WriteString("    " + path + "\n")
+		}
+	}
+	if len(s.MissingFiles) > 0 {
+		buffer.WriteString("\nnewly missing files:\n")
+		for _, path := range s.MissingFiles {
+			buffer.WriteString("    " + path + "\n")
+		}
+	}
+	if s.Changed > len(s.ChangedFiles) || s.Missing > len(s.MissingFiles) {
+		buffer.WriteString(fmt.Sprintf("\nonly the largest %v files of each are listed\n", notifyListLimit))
+	}
+	return buffer.String()
+}
+
+// notifier delivers a summary
+type notifier interface {
+	Notify(s Summary) error
+}
+
+type webhookNotifier struct {
+	url string
+}
+
+// Notify posts the summary as JSON
+func (n webhookNotifier) Notify(s Summary) error {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(n.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %v", resp.Status)
+	}
+	return nil
+}
+
+type commandNotifier struct {
+	command string
+}
+
+// Notify runs the command with the summary on stdin and the numbers in the environment
+func (n commandNotifier) Notify(s Summary) error {
+	cmd := exec.Command("/bin/sh", "-c", n.command)
+	cmd.Stdin = strings.NewReader(s.Text())
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"CHECKSUMMER_ROOT="+s.Root,
+		"CHECKSUMMER_CHANGED="+strconv.Itoa(s.Changed),
+		"CHECKSUMMER_MISSING="+strconv.Itoa(s.Missing),
+		"CHECKSUMMER_MISSING_TOTAL="+strconv.Itoa(s.MissingTotal),
+		"CHECKSUMMER_READ_ERRORS="+strconv.Itoa(s.ReadErrors),
+	)
+	return cmd.Run()
+}
+
+type smtpNotifier struct {
+	addr     string
+	from     string
+	to       []string
+	user     string
+	password string
+}
+
+// Notify sends the summary as plain text mail
+func (n smtpNotifier) Notify(s Summary) error {
+	var auth smtp.Auth
+	if n.user != "" {
+		host, _, err := net.SplitHostPort(n.addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", n.user, n.password, host)
+	}
+
+	var msg bytes.Buffer
+	msg.WriteString("From: " + n.from + "\r\n")
+	msg.WriteString("To: " + strings.Join(n.to, ", ") + "\r\n")
+	msg.WriteString(fmt.Sprintf("Subject: checksummer: %v changed, %v missing, %v read errors in %v\r\n",
+		s.Changed, s.Missing, s.ReadErrors, s.Root))
+	msg.WriteString("Date: " + time.Unix(s.Finished, 0).Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(s.Text(), "\n", "\r\n", -1))
+	return smtp.SendMail(n.addr, auth, n.from, n.to, msg.Bytes())
+}
+
+// optionalOption returns an option, empty if not set
+func (db *DB) optionalOption(key string) string {
+	value, err := db.GetOption(key)
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+// notifyOption returns a notifier setting, empty if not set
+func (db *DB) notifyOption(name string) string {
+	return db.optionalOption("notify_" + name)
+}
+
+// notifyThreshold returns a threshold setting, 1 if not set
+func (db *DB) notifyThreshold(name string) int {
+	n, err := strconv.Atoi(db.notifyOption(name))
+	if err != nil {
+		return 1
+	}
+	return n
+}
+
+// notifiers returns the configured notifiers
+func (db *DB) notifiers() []notifier {
+	var notifiers []notifier
+	if url := db.notifyOption("webhook"); url != "" {
+		notifiers = append(notifiers, webhookNotifier{url: url})
+	}
+	if command := db.notifyOption("command"); command != "" {
+		notifiers = append(notifiers, commandNotifier{command: command})
+	}
+	if addr := db.notifyOption("smtp"); addr != "" {
+		var to []string
+		for _, recipient := range strings.Split(db.notifyOption("smtp_to"), ",") {
+			if recipient = strings.TrimSpace(recipient); recipient != "" {
+				to = append(to, recipient)
+			}
+		}
+		notifiers = append(notifiers, smtpNotifier{
+			addr:     addr,
+			from:     db.notifyOption("smtp_from"),
+			to:       to,
+			user:     db.notifyOption("smtp_user"),
+			password: db.notifyOption("smtp_password"),
+		})
+	}
+	return notifiers
+}
+
+// newlyMissing selects the files missing since the previous run, so that a
+// deleted file is reported once and not on every run until it is pruned
+const newlyMissing = "file_found = '0' AND id NOT IN (SELECT file_id FROM notified_missing)"
+
+// rememberMissing records the missing files as reported
+func (db *DB) rememberMissing() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM notified_missing")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO notified_missing(file_id) SELECT id FROM files WHERE file_found = '0'")
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetSummary collects the result of the last run from the database
+func (db *DB) GetSummary() (Summary, error) {
+	var s Summary
+	var err error
+	s.Root, err = db.GetOption("basepath")
+	checkErr(err)
+	s.Finished = time.Now().Unix()
+
+	s.Files, err = db.GetCount("SELECT count(id) FROM files WHERE file_found = '1'")
+	if err != nil {
+		return s, err
+	}
+	s.Changed, err = db.GetCount("SELECT count(id) FROM files WHERE checksum_ok = '0'")
+	if err != nil {
+		return s, err
+	}
+	s.Missing, err = db.GetCount("SELECT count(id) FROM files WHERE " + newlyMissing)
+	if err != nil {
+		return s, err
+	}
+	s.MissingTotal, err = db.GetCount("SELECT count(id) FROM files WHERE file_found = '0'")
+	if err != nil {
+		return s, err
+	}
+	s.ReadErrors, _ = strconv.Atoi(db.optionalOption("last_verify_read_errors"))
+
+	for _, list := range []struct {
+		paths *[]string
+		where string
+	}{
+		{&s.ChangedFiles, "checksum_ok = '0'"},
+		{&s.MissingFiles, newlyMissing},
+	} {
+		records, err := db.queryRecords(`SELECT id, filename, filesize, mtime, checksum_sha256
+                                          FROM files
+                                          WHERE `+list.where+`
+                                          ORDER BY filesize DESC
+                                          LIMIT ?`, notifyListLimit)
+		if err != nil {
+			return s, err
+		}
+		*list.paths = []string{}
+		for _, r := range records {
+			*list.paths = append(*list.paths, r.Path)
+		}
+	}
+	return s, nil
+}
+
+// Notify sends the summary of the last run to all notifiers if a threshold
+// is reached, or in any case when force is set, which does not count as a
+// run for the missing files. Failing notifiers are reported but do not stop
+// the others.
+func (db *DB) Notify(force bool) error {
+	notifiers := db.notifiers()
+	if len(notifiers) == 0 && force {
+		return fmt.Errorf("no notifiers configured, see notify -list")
+	}
+
+	s, err := db.GetSummary()
+	if err != nil {
+		return err
+	}
+	if !force {
+		// the next run reports the files missing since this one
+		err = db.rememberMissing()
+		if err != nil {
+			return err
+		}
+	}
+	if len(notifiers) == 0 {
+		return nil
+	}
+
+	reached := func(count int, name string) bool {
+		threshold := db.notifyThreshold(name)
+		return threshold > 0 && count >= threshold
+	}
+	if !force && !reached(s.Changed, "changed") && !reached(s.Missing, "missing") && !reached(s.ReadErrors, "read_errors") {
+		return nil
+	}
+
+	failed := 0
+	for _, n := range notifiers {
+		err := n.Notify(s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "notification failed: %v\n", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v of %v notifications failed", failed, len(notifiers))
+	}
+	fmt.Printf("notification sent to %v notifiers\n", len(notifiers))
+	return nil
+}
+
+func cmdNotify(db *DB, args []string) error {
+	flags := flag.NewFlagSet("notify", flag.ExitOnError)
+	list := flags.Bool("list", false, "show the notifier settings")
+	set := flags.String("set", "", "change a setting, e.g. webhook=https://example.com/hook; an empty value disables it")
+	test := flags.Bool("test", false, "send the current summary regardless of the thresholds")
+	flags.Parse(args)
+
+	switch {
+	case *list:
+		for _, o := range notifyOptions {
+			value := db.notifyOption(o.name)
+			if o.name == "smtp_password" && value != "" {
+				value = "********"
+			}
+			fmt.Printf("%-14v %-40v %v\n", o.name, value, o.help)
+		}
+		return nil
+	case *set != "":
+		parts := strings.SplitN(*set, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("use -set NAME=VALUE")
+		}
+		for _, o := range notifyOptions {
+			if o.name == parts[0] {
+				return db.SetOption("notify_"+parts[0], parts[1])
+			}
+		}
+		return fmt.Errorf("unknown setting %q, see notify -list", parts[0])
+	}
+	return db.Notify(*test)
+}
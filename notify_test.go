@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// testDB opens a new database in a temporary directory with files, the
+// missing ones are named missing*
+func testDB(t *testing.T, files ...string) *DB {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetOption("basepath", "/data/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range files {
+		_, err = db.Exec("INSERT INTO files(filename, filesize, mtime, file_found) VALUES(?, 1, 1, ?)",
+			name, !strings.HasPrefix(name, "missing"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// webhook returns a stand-in server collecting the summaries posted to it
+func webhook(t *testing.T) (*httptest.Server, *[]Summary) {
+	var received []Summary
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var s Summary
+		err := json.NewDecoder(r.Body).Decode(&s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received = append(received, s)
+	}))
+	t.Cleanup(server.Close)
+	return server, &received
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	server, received := webhook(t)
+	s := Summary{Root: "/data/", Files: 3, Changed: 1, ChangedFiles: []string{"/data/a"}}
+	err := webhookNotifier{url: server.URL}.Notify(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*received) != 1 || (*received)[0].Changed != 1 || (*received)[0].ChangedFiles[0] != "/data/a" {
+		t.Errorf("received %+v", *received)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	err = webhookNotifier{url: failing.URL}.Notify(s)
+	if err == nil {
+		t.Error("no error for a failing webhook")
+	}
+}
+
+func TestCommandNotifier(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs /bin/sh")
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	s := Summary{Root: "/data/", Files: 3, Changed: 2, Missing: 1, MissingTotal: 4}
+	err := commandNotifier{command: "cat > " + out + "; echo $CHECKSUMMER_CHANGED $CHECKSUMMER_MISSING >> " + out}.Notify(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(content), s.Text()) || !strings.HasSuffix(string(content), "\n2 1\n") {
+		t.Errorf("command got %q", content)
+	}
+
+	err = commandNotifier{command: "exit 3"}.Notify(s)
+	if err == nil {
+		t.Error("no error for a failing command")
+	}
+}
+
+// smtpServer accepts one mail and sends the commands and the message it
+// received, or an error, on the channel
+func smtpServer(t *testing.T) (string, chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			received <- []string{err.Error()}
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		var lines []string
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				received <- append(lines, err.Error())
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			lines = append(lines, line)
+			switch command := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); command {
+			case "EHLO":
+				reply("250-localhost")
+				reply("250 AUTH PLAIN")
+			case "AUTH":
+				reply("235 ok")
+			case "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						received <- append(lines, err.Error())
+						return
+					}
+					line = strings.TrimRight(line, "\r\n")
+					if line == "." {
+						break
+					}
+					lines = append(lines, line)
+				}
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				received <- lines
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	db := testDB(t, "/a")
+	addr, received := smtpServer(t)
+	for name, value := range map[string]string{
+		"smtp":          addr,
+		"smtp_from":     "checksummer@example.com",
+		"smtp_to":       "a@example.com, b@example.com",
+		"smtp_user":     "user",
+		"smtp_password": "secret",
+	} {
+		err := db.SetOption("notify_"+name, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := db.Notify(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := <-received
+	mail := strings.Join(lines, "\n")
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret"))
+	for _, want := range []string{
+		"AUTH PLAIN " + credentials,
+		"MAIL FROM:<checksummer@example.com>",
+		"RCPT TO:<a@example.com>",
+		"RCPT TO:<b@example.com>",
+		"To: a@example.com, b@example.com",
+		"Subject: checksummer: 0 changed, 0 missing, 0 read errors in /data/",
+	} {
+		if !strings.Contains(mail, want) {
+			t.Errorf("no %q in\n%v", want, mail)
+		}
+	}
+}
+
+func TestNotifyMissingOnce(t *testing.T) {
+	db := testDB(t, "a", "missing1", "missing2")
+	server, received := webhook(t)
+	err := db.SetOption("notify_webhook", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Notify(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*received) != 1 || (*received)[0].Missing != 2 || (*received)[0].MissingTotal != 2 {
+		t.Fatalf("first run: received %+v", *received)
+	}
+
+	// nothing new
+	err = db.Notify(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*received) != 1 {
+		t.Fatalf("second run: received %+v", *received)
+	}
+
+	_, err = db.Exec("UPDATE files SET file_found = 0 WHERE filename = 'a'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Notify(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*received) != 2 {
+		t.Fatalf("third run: received %+v", *received)
+	}
+	s := (*received)[1]
+	if s.Missing != 1 || s.MissingTotal != 3 || len(s.MissingFiles) != 1 || s.MissingFiles[0] != "/data/a" {
+		t.Errorf("third run: received %+v", s)
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// maxShardsize is the size of the shards large files are split into
+	maxShardsize = 64 << 10
+	// minShardsize keeps the per-shard overhead reasonable for small files
+	minShardsize = 512
+	// stripeShards is the number of data shards protected together
+	stripeShards = 100
+)
+
+// ParityFile describes the recovery data stored for a file
+type ParityFile struct {
+	File
+	Shardsize  int64
+	Redundancy int
+}
+
+// stripes returns the number of stripes the file is split into
+func (p ParityFile) stripes() int64 {
+	shards := (p.Size + p.Shardsize - 1) / p.Shardsize
+	return (shards + stripeShards - 1) / stripeShards
+}
+
+// stripeLayout returns the number of data and parity shards of a stripe
+func (p ParityFile) stripeLayout(stripe int64) (k int, m int) {
+	shards := (p.Size + p.Shardsize - 1) / p.Shardsize
+	k = stripeShards
+	if rest := shards - stripe*stripeShards; rest < stripeShards {
+		k = int(rest)
+	}
+	m = (k*p.Redundancy + 99) / 100
+	if m < 1 {
+		m = 1
+	}
+	return k, m
+}
+
+// shardsizeFor picks a shard size so that small files still get enough shards
+func shardsizeFor(filesize int64) int64 {
+	size := (filesize + stripeShards - 1) / stripeShards
+	if size > maxShardsize {
+		return maxShardsize
+	}
+	if size < minShardsize {
+		return minShardsize
+	}
+	return size
+}
+
+func hashShard(shard []byte) string {
+	sum := sha256.Sum256(shard)
+	return hex.EncodeToString(sum[:])
+}
+
+// readStripe reads k shards of the given size, padding the end of the file with zeros
+func readStripe(r io.Reader, k int, shardsize int64) ([][]byte, error) {
+	buf := make([]byte, int64(k)*shardsize)
+	_, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	shards := make([][]byte, k)
+	for i := range shards {
+		shards[i] = buf[int64(i)*shardsize : int64(i+1)*shardsize]
+	}
+	return shards, nil
+}
+
+// normalizeSelection turns absolute paths below the basepath into filename prefixes
+func normalizeSelection(basepath string, paths []string) []string {
+	var prefixes []string
+	for _, path := range paths {
+		path = strings.TrimPrefix(path, basepath)
+		path = strings.TrimRight(path, "/")
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		prefixes = append(prefixes, path)
+	}
+	return prefixes
+}
+
+// MakeParity generates Reed-Solomon recovery data for the selected files or folders.
+// redundancy is the amount of parity in percent of the data.
+func (db *DB) MakeParity(paths []string, redundancy int) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("no files or folders given")
+	}
+	if redundancy < 1 || redundancy > 100 {
+		return fmt.Errorf("redundancy must be between 1 and 100 percent")
+	}
+
+	// get basepath
+	basepath, err := db.GetOption("basepath")
+	checkErr(err)
+
+	var files []File
+	for _, prefix := range normalizeSelection(basepath, paths) {
+		rows, err := db.Query(`SELECT id, filename, filesize, checksum_sha256
+                                FROM files
+                                WHERE file_found = '1'
+                                AND checksum_sha256 IS NOT NULL
+                                AND (filename = ? OR substr(filename, 1, ?) = ?)`,
+			prefix, len(prefix)+1, prefix+"/")
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var file File
+			err = rows.Scan(&file.ID, &file.Name, &file.Size, &file.Checksum)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			files = append(files, file)
+		}
+		rows.Close()
+	}
+	if len(files) == 0 {
+		fmt.Println("no hashed files found, run [mc] first")
+		return nil
+	}
+
+	for i, file := range files {
+		path := basepath + file.Name
+		fmt.Printf("(%s) making parity: %s (%s)... ", thousandsSeparator(len(files)-i), path, ByteSize(file.Size))
+		err = db.makeFileParity(path, ParityFile{File: file, Shardsize: shardsizeFor(file.Size), Redundancy: redundancy})
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Println("OK")
+	}
+	return nil
+}
+
+func (db *DB) makeFileParity(path string, p ParityFile) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM parity_shards WHERE file_id = ?", p.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT OR REPLACE INTO parity_files(file_id, filesize, shardsize, redundancy)
+                        VALUES(?, ?, ?, ?)`, p.ID, p.Size, p.Shardsize, p.Redundancy)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT INTO parity_shards(file_id, stripe, shard, checksum_sha256, data) VALUES(?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	hasher := sha256.New()
+	remaining := p.Size
+	for stripe := int64(0); stripe < p.stripes(); stripe++ {
+		k, m := p.stripeLayout(stripe)
+		data, err := readStripe(f, k, p.Shardsize)
+		if err != nil {
+			return err
+		}
+		for i, shard := range data {
+			n := p.Shardsize
+			if remaining < n {
+				n = remaining
+			}
+			hasher.Write(shard[:n])
+			remaining -= n
+
+			_, err = stmt.Exec(p.ID, stripe, i, hashShard(shard), nil)
+			if err != nil {
+				return err
+			}
+		}
+		for i, shard := range rsEncode(data, m) {
+			_, err = stmt.Exec(p.ID, stripe, k+i, hashShard(shard), shard)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// never protect data that already differs from the recorded checksum
+	if hex.EncodeToString(hasher.Sum(nil)) != p.Checksum {
+		return fmt.Errorf("file does not match the recorded checksum, skipped")
+	}
+
+	return tx.Commit()
+}
+
+// loadParityShards returns the stored shards of a stripe; data shards have no content
+func (db *DB) loadParityShards(fileID int64, stripe int64) (checksums []string, parity [][]byte, err error) {
+	rows, err := db.Query(`SELECT checksum_sha256, data
+                            FROM parity_shards
+                            WHERE file_id = ? AND stripe = ?
+                            ORDER BY shard`, fileID, stripe)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var checksum string
+		var data []byte
+		err = rows.Scan(&checksum, &data)
+		if err != nil {
+			return nil, nil, err
+		}
+		checksums = append(checksums, checksum)
+		parity = append(parity, data)
+	}
+	return checksums, parity, rows.Err()
+}
+
+// ReconstructParity repairs changed files using their recovery data
+func (db *DB) ReconstructParity(dryRun bool) error {
+
+	// get basepath
+	basepath, err := db.GetOption("basepath")
+	checkErr(err)
+
+	rows, err := db.Query(`SELECT f.id, f.filename, f.checksum_sha256, p.filesize, p.shardsize, p.redundancy
+                            FROM files f
+                            JOIN parity_files p ON p.file_id = f.id
+                            WHERE f.checksum_ok = '0'`)
+	if err != nil {
+		return err
+	}
+	var files []ParityFile
+	for rows.Next() {
+		var p ParityFile
+		err = rows.Scan(&p.ID, &p.Name, &p.Checksum, &p.Size, &p.Shardsize, &p.Redundancy)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		files = append(files, p)
+	}
+	rows.Close()
+
+	if len(files) == 0 {
+		fmt.Println("no changed files with parity data")
+		return nil
+	}
+
+	for _, p := range files {
+		path := basepath + p.Name
+		fmt.Printf("reconstructing: %s... ", path)
+		damaged, err := db.reconstructFile(path, p, dryRun)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if dryRun {
+			fmt.Printf("%v damaged shards, repairable\n", damaged)
+			continue
+		}
+		fmt.Printf("%v damaged shards repaired\n", damaged)
+
+		fi, err := os.Stat(path)
+		checkErr(err)
+		_, err = db.Exec(`UPDATE files
+                            SET checksum_ok = 1, checked = ?, filesize = ?, mtime = ?
+                            WHERE id = ?`, time.Now().Unix(), fi.Size(), fi.ModTime().Unix(), p.ID)
+		checkErr(err)
+		_, err = db.Exec("UPDATE chunks SET chunk_ok = 1 WHERE file_id = ?", p.ID)
+		checkErr(err)
+	}
+	return nil
+}
+
+// reconstructFile writes a repaired copy of the file next to it and replaces
+// the original once the copy matches the recorded checksum
+func (db *DB) reconstructFile(path string, p ParityFile, dryRun bool) (damaged int, err error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var out *os.File
+	if !dryRun {
+		out, err = os.OpenFile(path+".checksummer-tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+		if err != nil {
+			return 0, err
+		}
+		defer os.Remove(out.Name())
+		defer out.Close()
+	}
+
+	hasher := sha256.New()
+	remaining := p.Size
+	for stripe := int64(0); stripe < p.stripes(); stripe++ {
+		k, m := p.stripeLayout(stripe)
+		checksums, stored, err := db.loadParityShards(p.ID, stripe)
+		if err != nil {
+			return 0, err
+		}
+		// every shard has a row, the data shards for their checksums
+		if len(checksums) != k+m {
+			return 0, fmt.Errorf("recovery data of stripe %v is incomplete: %v of %v shards", stripe, len(checksums), k+m)
+		}
+		data, err := readStripe(in, k, p.Shardsize)
+		if err != nil {
+			return 0, err
+		}
+
+		// shards that do not match their checksum are treated as lost
+		shards := make([][]byte, len(checksums))
+		for i := range shards {
+			if i < k {
+				shards[i] = data[i]
+			} else {
+				shards[i] = stored[i]
+			}
+			if hashShard(shards[i]) != checksums[i] {
+				shards[i] = nil
+				if i < k {
+					damaged++
+				}
+			}
+		}
+
+		err = rsReconstruct(shards, k)
+		if err != nil {
+			return damaged, err
+		}
+
+		for _, shard := range shards[:k] {
+			n := p.Shardsize
+			if remaining < n {
+				n = remaining
+			}
+			hasher.Write(shard[:n])
+			remaining -= n
+			if !dryRun {
+				_, err = out.Write(shard[:n])
+				if err != nil {
+					return damaged, err
+				}
+			}
+		}
+	}
+
+	if hex.EncodeToString(hasher.Sum(nil)) != p.Checksum {
+		return damaged, fmt.Errorf("reconstructed file does not match the recorded checksum")
+	}
+	if dryRun {
+		return damaged, nil
+	}
+
+	err = out.Sync()
+	if err != nil {
+		return damaged, err
+	}
+	err = out.Close()
+	if err != nil {
+		return damaged, err
+	}
+	err = os.Chtimes(out.Name(), fi.ModTime(), fi.ModTime())
+	if err != nil {
+		return damaged, err
+	}
+	return damaged, os.Rename(out.Name(), path)
+}
+
+// pruneParity removes the recovery data of files matching the given condition
+func (db *DB) pruneParity(condition string) error {
+	_, err := db.Exec("DELETE FROM parity_shards WHERE file_id IN (SELECT id FROM files WHERE " + condition + ")")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM parity_files WHERE file_id IN (SELECT id FROM files WHERE " + condition + ")")
+	return err
+}
+
+func cmdParity(db *DB, args []string) error {
+	flags := flag.NewFlagSet("parity", flag.ExitOnError)
+	redundancy := flags.Int("r", 10, "redundancy in percent of the data")
+	flags.Parse(args)
+
+	return db.MakeParity(flags.Args(), *redundancy)
+}
+
+func cmdReconstruct(db *DB, args []string) error {
+	flags := flag.NewFlagSet("reconstruct", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "dry run, only check whether files can be reconstructed")
+	flags.Parse(args)
+
+	return db.ReconstructParity(*dryRun)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReconstructFile(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	path := filepath.Join(dir, "a")
+	err := ioutil.WriteFile(path, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	db := testDB(t)
+	err = db.SetOption("basepath", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO files(filename, filesize, mtime, file_found, checksum_sha256) VALUES('/a', ?, 1, 1, ?)",
+		len(content), hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.MakeParity([]string{path}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ParityFile{File: File{ID: 1, Name: "/a", Size: int64(len(content)), Checksum: hex.EncodeToString(sum[:])}}
+	err = db.QueryRow("SELECT shardsize, redundancy FROM parity_files WHERE file_id = 1").Scan(&p.Shardsize, &p.Redundancy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	damaged := append([]byte{}, content...)
+	damaged[100] ^= 0xff
+	err = ioutil.WriteFile(path, damaged, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := db.reconstructFile(path, p, false)
+	if err != nil || n != 1 {
+		t.Fatalf("%v damaged shards, %v", n, err)
+	}
+	repaired, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(repaired, content) {
+		t.Error("file not repaired")
+	}
+
+	// lost rows of recovery data are reported, not indexed past
+	_, err = db.Exec("DELETE FROM parity_shards WHERE file_id = 1 AND stripe = 0 AND shard > 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.reconstructFile(path, p, true)
+	if err == nil {
+		t.Error("no error for missing shards")
+	}
+}
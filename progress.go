@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// progressInterval is how often the progress line is redrawn
+	progressInterval = 200 * time.Millisecond
+	// progressLogInterval is how often a line is logged when stdout is not a terminal
+	progressLogInterval = 10 * time.Second
+	// rateSmoothing weights the latest throughput sample in the moving average
+	rateSmoothing = 0.1
+)
+
+// Progress displays files and bytes done, throughput and ETA of a long running operation.
+// On a terminal a single line is updated, otherwise a line is logged periodically.
+// Progress is an io.Writer counting the bytes written to it.
+type Progress struct {
+	label      string
+	totalFiles int
+	totalBytes int64
+	doneFiles  int
+	doneBytes  int64
+	current    string
+	fileStart  int64
+	tty        bool
+	start      time.Time
+	lastDraw   time.Time
+	lastBytes  int64
+	lastHook   time.Time
+	rate       float64 // bytes per second, moving average
+}
+
+// ProgressState is a copy of the state of a running operation
+type ProgressState struct {
+	Label      string  `json:"label"`
+	Files      int     `json:"files"`
+	TotalFiles int     `json:"total_files"`
+	Bytes      int64   `json:"bytes"`
+	TotalBytes int64   `json:"total_bytes"`
+	Current    string  `json:"current"`
+	Rate       float64 `json:"rate"`
+	Done       bool    `json:"done"`
+}
+
+// progressHook, when set, is called with the state of every running
+// operation, e.g. to report it over HTTP
+var progressHook func(state ProgressState)
+
+// NewProgress starts reporting progress for the given amount of work
+func NewProgress(label string, files int, bytes int64) *Progress {
+	now := time.Now()
+	return &Progress{
+		label:      label,
+		totalFiles: files,
+		totalBytes: bytes,
+		tty:        isTerminal(os.Stdout),
+		start:      now,
+		lastDraw:   now,
+	}
+}
+
+// StartFile sets the file currently being processed
+func (p *Progress) StartFile(path string) {
+	p.current = path
+	p.fileStart = p.doneBytes
+	p.update(false)
+}
+
+// FinishFile marks the current file as done. Bytes of the file that were
+// not read, e.g. because it was not found, are skipped.
+func (p *Progress) FinishFile(size int64) {
+	p.doneFiles++
+	if skipped := size - (p.doneBytes - p.fileStart); skipped > 0 {
+		p.doneBytes += skipped
+		p.lastBytes += skipped
+	}
+	p.update(false)
+}
+
+// Write counts bytes read from the current file
+func (p *Progress) Write(b []byte) (int, error) {
+	p.doneBytes += int64(len(b))
+	p.update(false)
+	return len(b), nil
+}
+
+// Println prints a message without garbling the progress line
+func (p *Progress) Println(a ...interface{}) {
+	if p.tty {
+		fmt.Print("\r" + clearLine)
+	}
+	fmt.Println(a...)
+	if p.tty {
+		p.update(true)
+	}
+}
+
+// Finish prints the final state of the operation
+func (p *Progress) Finish() {
+	p.current = ""
+	elapsed := time.Since(p.start)
+	if p.tty {
+		fmt.Print("\r" + clearLine)
+	}
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.doneBytes) / elapsed.Seconds()
+	}
+	fmt.Printf("%s: %s files, %v in %v (%v/s)\n", p.label, thousandsSeparator(p.doneFiles), ByteSize(p.doneBytes),
+		elapsed.Truncate(time.Second), ByteSize(rate))
+	if progressHook != nil {
+		state := p.state()
+		state.Rate = rate
+		state.Done = true
+		progressHook(state)
+	}
+}
+
+func (p *Progress) state() ProgressState {
+	return ProgressState{
+		Label:      p.label,
+		Files:      p.doneFiles,
+		TotalFiles: p.totalFiles,
+		Bytes:      p.doneBytes,
+		TotalBytes: p.totalBytes,
+		Current:    p.current,
+		Rate:       p.rate,
+	}
+}
+
+func (p *Progress) update(force bool) {
+	now := time.Now()
+	elapsed := now.Sub(p.lastDraw)
+	if !force && elapsed < progressInterval {
+		return
+	}
+	if progressHook != nil && (force || now.Sub(p.lastHook) >= progressInterval) {
+		p.lastHook = now
+		progressHook(p.state())
+	}
+	if !p.tty && !force && elapsed < progressLogInterval {
+		return
+	}
+
+	if elapsed >= progressInterval {
+		sample := float64(p.doneBytes-p.lastBytes) / elapsed.Seconds()
+		if p.rate == 0 {
+			p.rate = sample
+		} else {
+			p.rate = rateSmoothing*sample + (1-rateSmoothing)*p.rate
+		}
+	}
+	p.lastDraw = now
+	p.lastBytes = p.doneBytes
+
+	if p.tty {
+		_, cols := terminalSize()
+		fmt.Print("\r" + clearLine + truncate(p.line(true), cols))
+	} else {
+		fmt.Println(p.line(false))
+	}
+}
+
+func (p *Progress) line(bar bool) string {
+	percent := 100.0
+	if p.totalBytes > 0 {
+		percent = float64(p.doneBytes) * 100 / float64(p.totalBytes)
+	} else if p.totalFiles > 0 {
+		percent = float64(p.doneFiles) * 100 / float64(p.totalFiles)
+	}
+	if percent > 100 {
+		percent = 100
+	}
+
+	eta := "--:--:--"
+	if p.rate > 0 && p.totalBytes >= p.doneBytes {
+		eta = formatDuration(time.Duration(float64(p.totalBytes-p.doneBytes) / p.rate * float64(time.Second)))
+	}
+
+	var s string
+	if bar {
+		const width = 20
+		filled := int(percent / 100 * width)
+		s = "[" + strings.Repeat("#", filled) + strings.Repeat(".", width-filled) + "] "
+	} else {
+		s = p.label + ": "
+	}
+	s += fmt.Sprintf("%3.0f%%  %s/%s files  %v/%v  %v/s  ETA %s",
+		percent, thousandsSeparator(p.doneFiles), thousandsSeparator(p.totalFiles),
+		ByteSize(p.doneBytes), ByteSize(p.totalBytes), ByteSize(p.rate), eta)
+	if p.current != "" {
+		s += "  " + p.current
+	}
+	return s
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := d / time.Hour
+	m := (d % time.Hour) / time.Minute
+	s := (d % time.Minute) / time.Second
+	return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Query is a parsed search expression. All terms must match:
+//
+//	word            filename contains word
+//	"two words"     filename contains the quoted text
+//	*.jpg           glob on the path relative to the basepath
+//	re:^/photos/    regular expression on the path relative to the basepath
+//	ext:jpg,png     extension is one of the list
+//	size>1G         filesize compared with >, >=, <, <=, = or a range size:1M..1G
+//	modified<2015   mtime compared with a date (2015, 2015-01 or 2015-01-31) or a range modified:2010..2012
+//	is:deleted      status: deleted, found, changed, verified, hashed or unhashed
+//	sha:3f2a        checksum starts with the given prefix
+//
+// Any term can be negated with a leading -.
+type Query struct {
+	where   []string
+	args    []interface{}
+	terms   []queryTerm
+	regexps []queryRegexp
+}
+
+// queryTerm is a plain substring of the filename
+type queryTerm struct {
+	text   string
+	negate bool
+}
+
+type queryRegexp struct {
+	re     *regexp.Regexp
+	negate bool
+}
+
+var queryStatus = map[string]string{
+	"deleted":  "file_found = '0'",
+	"found":    "file_found = '1'",
+	"changed":  "checksum_ok = '0'",
+	"verified": "checksum_ok = '1'",
+	"hashed":   "checksum_sha256 IS NOT NULL",
+	"unhashed": "checksum_sha256 IS NULL",
+}
+
+var queryOperator = regexp.MustCompile(`^(size|modified):?(>=|<=|>|<|=)(.*)$`)
+
+// ParseQuery parses a search expression
+func ParseQuery(expr string) (*Query, error) {
+	q := &Query{}
+	for _, token := range tokenizeQuery(expr) {
+		negate := false
+		if len(token) > 1 && token[0] == '-' {
+			negate = true
+			token = token[1:]
+		}
+		err := q.addTerm(token, negate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// tokenizeQuery splits the expression at whitespace, keeping quoted text together
+func tokenizeQuery(expr string) []string {
+	var tokens []string
+	var current strings.Builder
+	quoted := false
+	for _, r := range expr {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case unicode.IsSpace(r) && !quoted:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
+
+func (q *Query) add(negate bool, clause string, args ...interface{}) {
+	if negate {
+		clause = "NOT (" + clause + ")"
+	}
+	q.where = append(q.where, clause)
+	q.args = append(q.args, args...)
+}
+
+func (q *Query) addTerm(token string, negate bool) error {
+	if m := queryOperator.FindStringSubmatch(token); m != nil {
+		return q.addComparison(m[1], m[2], m[3], negate)
+	}
+
+	key, value := "", token
+	if i := strings.Index(token, ":"); i > 0 {
+		key, value = token[:i], token[i+1:]
+	}
+
+	switch key {
+	case "re":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return fmt.Errorf("invalid regular expression %q: %v", value, err)
+		}
+		q.regexps = append(q.regexps, queryRegexp{re: re, negate: negate})
+		return nil
+	case "ext":
+		var clauses []string
+		for _, ext := range strings.Split(value, ",") {
+			ext = strings.TrimPrefix(ext, ".")
+			clauses = append(clauses, `filename LIKE ? ESCAPE '\'`)
+			q.args = append(q.args, "%."+escapeLike(ext))
+		}
+		clause := "(" + strings.Join(clauses, " OR ") + ")"
+		if negate {
+			clause = "NOT " + clause
+		}
+		q.where = append(q.where, clause)
+		return nil
+	case "is":
+		clause, ok := queryStatus[value]
+		if !ok {
+			return fmt.Errorf("unknown status %q", value)
+		}
+		q.add(negate, clause)
+		return nil
+	case "sha", "checksum":
+		q.add(negate, `checksum_sha256 LIKE ? ESCAPE '\'`, escapeLike(strings.ToLower(value))+"%")
+		return nil
+	case "size", "modified":
+		return q.addComparison(key, ":", value, negate)
+	}
+
+	if strings.ContainsAny(token, "*?[") {
+		pattern := token
+		if !strings.HasPrefix(pattern, "/") && !strings.HasPrefix(pattern, "*") {
+			pattern = "*" + pattern
+		}
+		q.add(negate, "filename GLOB ?", pattern)
+		return nil
+	}
+
+	q.terms = append(q.terms, queryTerm{text: token, negate: negate})
+	return nil
+}
+
+// addComparison handles size and modified filters with an operator or a range
+func (q *Query) addComparison(key string, op string, value string, negate bool) error {
+	column := "filesize"
+	parse := func(s string) (int64, int64, error) {
+		size, err := parseSize(s)
+		return size, size + 1, err
+	}
+	if key == "modified" {
+		column = "mtime"
+		parse = parseDate
+	}
+
+	if op == ":" && strings.Contains(value, "..") {
+		bounds := strings.SplitN(value, "..", 2)
+		var clauses []string
+		var args []interface{}
+		if bounds[0] != "" {
+			start, _, err := parse(bounds[0])
+			if err != nil {
+				return err
+			}
+			clauses = append(clauses, column+" >= ?")
+			args = append(args, start)
+		}
+		if bounds[1] != "" {
+			_, end, err := parse(bounds[1])
+			if err != nil {
+				return err
+			}
+			clauses = append(clauses, column+" < ?")
+			args = append(args, end)
+		}
+		if len(clauses) == 0 {
+			return fmt.Errorf("empty range in %s:%s", key, value)
+		}
+		q.add(negate, strings.Join(clauses, " AND "), args...)
+		return nil
+	}
+
+	// start is the first value matching, end the first value after it;
+	// for dates this covers the whole year, month or day given
+	start, end, err := parse(value)
+	if err != nil {
+		return err
+	}
+	switch op {
+	case "<":
+		q.add(negate, column+" < ?", start)
+	case "<=":
+		q.add(negate, column+" < ?", end)
+	case ">":
+		q.add(negate, column+" >= ?", end)
+	case ">=":
+		q.add(negate, column+" >= ?", start)
+	default:
+		q.add(negate, column+" >= ? AND "+column+" < ?", start, end)
+	}
+	return nil
+}
+
+// parseSize parses sizes like 1500, 10K, 1.5G or 2TB
+func parseSize(s string) (int64, error) {
+	units := map[string]float64{"": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40, "P": 1 << 50}
+	upper := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	i := strings.IndexFunc(upper, func(r rune) bool { return !unicode.IsDigit(r) && r != '.' })
+	number, unit := upper, ""
+	if i >= 0 {
+		number, unit = upper[:i], upper[i:]
+	}
+	factor, ok := units[unit]
+	n, err := strconv.ParseFloat(number, 64)
+	if !ok || err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * factor), nil
+}
+
+// parseDate parses 2015, 2015-01, 2015-01-31 or 2015-01-31T12:00:00 in local
+// time and returns the start and the end of that period as unix timestamps
+func parseDate(s string) (int64, int64, error) {
+	layouts := []struct {
+		layout string
+		years  int
+		months int
+		days   int
+		secs   time.Duration
+	}{
+		{"2006", 1, 0, 0, 0},
+		{"2006-01", 0, 1, 0, 0},
+		{"2006-01-02", 0, 0, 1, 0},
+		{"2006-01-02T15:04:05", 0, 0, 0, time.Second},
+	}
+	for _, l := range layouts {
+		t, err := time.ParseInLocation(l.layout, s, time.Local)
+		if err == nil {
+			end := t.AddDate(l.years, l.months, l.days).Add(l.secs)
+			return t.Unix(), end.Unix(), nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid date %q, use YYYY, YYYY-MM or YYYY-MM-DD", s)
+}
+
+func escapeLike(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "%", `\%`, -1)
+	return strings.Replace(s, "_", `\_`, -1)
+}
+
+// Where returns the SQL condition and its arguments.
+// With index set, substrings are looked up in the filename index.
+func (q *Query) Where(index bool) (string, []interface{}) {
+	where := q.where
+	args := q.args
+	for _, t := range q.terms {
+		clause := `filename LIKE ? ESCAPE '\'`
+		arg := "%" + escapeLike(t.text) + "%"
+		if index && len([]rune(t.text)) >= minIndexTerm {
+			clause = "id IN (SELECT rowid FROM files_fts WHERE files_fts MATCH ?)"
+			arg = ftsPhrase(t.text)
+		}
+		if t.negate {
+			clause = "NOT (" + clause + ")"
+		}
+		where = append(where, clause)
+		args = append(args, arg)
+	}
+	if len(where) == 0 {
+		return "1", nil
+	}
+	return strings.Join(where, " AND "), args
+}
+
+// Match applies the filters that cannot be expressed in SQL to a filename
+func (q *Query) Match(filename string) bool {
+	for _, r := range q.regexps {
+		if r.re.MatchString(filename) == r.negate {
+			return false
+		}
+	}
+	return true
+}
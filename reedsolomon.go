@@ -0,0 +1,163 @@
+package main
+
+import "errors"
+
+// Reed-Solomon erasure coding over GF(2^8) with a systematic Cauchy matrix.
+// Up to m lost shards of a stripe can be rebuilt from any k remaining ones.
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd computes dst ^= c * src
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	var table [256]byte
+	for i := range table {
+		table[i] = gfMul(c, byte(i))
+	}
+	for i, b := range src {
+		dst[i] ^= table[b]
+	}
+}
+
+// cauchyRow returns the coefficients of parity shard i for k data shards
+func cauchyRow(i, k int) []byte {
+	row := make([]byte, k)
+	for j := range row {
+		row[j] = gfInv(byte(k+i) ^ byte(j))
+	}
+	return row
+}
+
+// rsEncode returns m parity shards for the given equally sized data shards
+func rsEncode(data [][]byte, m int) [][]byte {
+	k := len(data)
+	parity := make([][]byte, m)
+	for i := range parity {
+		parity[i] = make([]byte, len(data[0]))
+		for j, c := range cauchyRow(i, k) {
+			gfMulAdd(parity[i], data[j], c)
+		}
+	}
+	return parity
+}
+
+// rsReconstruct rebuilds the missing (nil) data shards of a stripe.
+// shards holds k data shards followed by the parity shards.
+func rsReconstruct(shards [][]byte, k int) error {
+	var missing []int
+	for j := 0; j < k; j++ {
+		if shards[j] == nil {
+			missing = append(missing, j)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	// pick k intact shards and the matrix rows that produced them
+	var rows [][]byte
+	var present [][]byte
+	for r := 0; r < len(shards) && len(rows) < k; r++ {
+		if shards[r] == nil {
+			continue
+		}
+		var row []byte
+		if r < k {
+			row = make([]byte, k)
+			row[r] = 1
+		} else {
+			row = cauchyRow(r-k, k)
+		}
+		rows = append(rows, row)
+		present = append(present, shards[r])
+	}
+	if len(rows) < k {
+		return errors.New("too many damaged shards to reconstruct")
+	}
+
+	inv, err := gfInvert(rows)
+	if err != nil {
+		return err
+	}
+
+	for _, j := range missing {
+		shard := make([]byte, len(present[0]))
+		for l, c := range inv[j] {
+			gfMulAdd(shard, present[l], c)
+		}
+		shards[j] = shard
+	}
+	return nil
+}
+
+// gfInvert inverts a square matrix by Gauss-Jordan elimination
+func gfInvert(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	work := make([][]byte, n)
+	for i := range work {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], matrix[i])
+		work[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if work[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot == -1 {
+			return nil, errors.New("matrix is singular")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		scale := gfInv(work[col][col])
+		for c := range work[col] {
+			work[col][c] = gfMul(work[col][c], scale)
+		}
+		for r := 0; r < n; r++ {
+			if r != col && work[r][col] != 0 {
+				gfMulAdd(work[r], work[col], work[r][col])
+			}
+		}
+	}
+
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = work[i][n:]
+	}
+	return inv, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if p := gfMul(byte(a), gfInv(byte(a))); p != 1 {
+			t.Errorf("%v * inv(%v) = %v", a, a, p)
+		}
+	}
+}
+
+func TestGFInvert(t *testing.T) {
+	// rows of the code: some identity rows and some parity rows
+	k := 5
+	var matrix [][]byte
+	for _, r := range []int{0, 2, 4} {
+		row := make([]byte, k)
+		row[r] = 1
+		matrix = append(matrix, row)
+	}
+	matrix = append(matrix, cauchyRow(1, k), cauchyRow(3, k))
+
+	inv, err := gfInvert(matrix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < k; i++ {
+		for j := 0; j < k; j++ {
+			var sum byte
+			for l := 0; l < k; l++ {
+				sum ^= gfMul(matrix[i][l], inv[l][j])
+			}
+			want := byte(0)
+			if i == j {
+				want = 1
+			}
+			if sum != want {
+				t.Fatalf("matrix * inverse is not the identity at %v,%v: %v", i, j, sum)
+			}
+		}
+	}
+
+	_, err = gfInvert([][]byte{{1, 2}, {1, 2}})
+	if err == nil {
+		t.Error("no error for a singular matrix")
+	}
+}
+
+// erasureSets returns sets of up to m of n shards to erase: every set for
+// small stripes, otherwise the first and the last shards, the last data
+// shard, which is the short one of a file, and random sets
+func erasureSets(n int, k int, m int, rng *rand.Rand) [][]int {
+	var sets [][]int
+	if n <= 12 {
+		for bits := 1; bits < 1<<uint(n); bits++ {
+			var set []int
+			for i := 0; i < n; i++ {
+				if bits&(1<<uint(i)) != 0 {
+					set = append(set, i)
+				}
+			}
+			if len(set) <= m {
+				sets = append(sets, set)
+			}
+		}
+		return sets
+	}
+
+	first := []int{}
+	last := []int{}
+	shortData := []int{}
+	for i := 0; i < m; i++ {
+		first = append(first, i)
+		last = append(last, n-m+i)
+		shortData = append(shortData, k-m+i)
+	}
+	sets = append(sets, first, last, shortData, []int{k - 1})
+	for i := 0; i < 50; i++ {
+		set := rng.Perm(n)[:1+rng.Intn(m)]
+		sets = append(sets, set)
+	}
+	return sets
+}
+
+func TestRSRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, c := range []struct {
+		size       int64
+		shardsize  int64
+		redundancy int
+	}{
+		{1, 512, 10},
+		{512, 512, 10},
+		{5*512 + 100, 512, 40},
+		{9*512 + 1, 512, 25},
+		{250*512 + 7, 512, 10},
+	} {
+		content := make([]byte, c.size)
+		rng.Read(content)
+		p := ParityFile{File: File{Size: c.size}, Shardsize: c.shardsize, Redundancy: c.redundancy}
+
+		in := bytes.NewReader(content)
+		var rebuilt []byte
+		for stripe := int64(0); stripe < p.stripes(); stripe++ {
+			k, m := p.stripeLayout(stripe)
+			data, err := readStripe(in, k, p.Shardsize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parity := rsEncode(data, m)
+			all := append(append([][]byte{}, data...), parity...)
+
+			for _, set := range erasureSets(k+m, k, m, rng) {
+				shards := append([][]byte{}, all...)
+				for _, i := range set {
+					shards[i] = nil
+				}
+				err = rsReconstruct(shards, k)
+				if err != nil {
+					t.Fatalf("size %v stripe %v erasing %v: %v", c.size, stripe, set, err)
+				}
+				for j := 0; j < k; j++ {
+					if !bytes.Equal(shards[j], data[j]) {
+						t.Fatalf("size %v stripe %v erasing %v: shard %v differs", c.size, stripe, set, j)
+					}
+				}
+			}
+
+			// one more than the parity count is too many
+			shards := append([][]byte{}, all...)
+			shards[rng.Intn(k)] = nil
+			for i := k; i < k+m; i++ {
+				shards[i] = nil
+			}
+			if err = rsReconstruct(shards, k); err == nil {
+				t.Errorf("size %v stripe %v: no error with %v shards lost", c.size, stripe, m+1)
+			}
+
+			for _, shard := range data {
+				rebuilt = append(rebuilt, shard...)
+			}
+		}
+
+		// the padding of the last short shard is not part of the file
+		if !bytes.Equal(rebuilt[:c.size], content) {
+			t.Errorf("size %v: stripes do not add up to the file", c.size)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink makes dst share the data blocks of src, only supported on Linux
+func reflink(src *os.File, dst *os.File) error {
+	return errors.New("reflinks are not supported on this platform")
+}
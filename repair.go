@@ -0,0 +1,257 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RepairOptions controls where Repair looks for good copies and how it restores them
+type RepairOptions struct {
+	Sources []string // backup roots or other checksummer databases
+	DryRun  bool     // only report what would be done
+	Suffix  string   // restore alongside the bad file instead of over it
+}
+
+// repairSource finds candidate copies of a file
+type repairSource interface {
+	Candidates(file File) ([]string, error)
+	Close()
+}
+
+// rootSource is a directory mirroring the basepath
+type rootSource string
+
+func (r rootSource) Candidates(file File) ([]string, error) {
+	return []string{string(r) + file.Name}, nil
+}
+
+func (r rootSource) Close() {}
+
+// dbSource is another checksummer database, looked up by checksum
+type dbSource struct {
+	db       *DB
+	basepath string
+}
+
+func (s dbSource) Candidates(file File) ([]string, error) {
+	rows, err := s.db.Query("SELECT filename FROM files WHERE checksum_sha256 = ?", file.Checksum)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var filename string
+		err = rows.Scan(&filename)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, s.basepath+filename)
+	}
+	return paths, rows.Err()
+}
+
+func (s dbSource) Close() {
+	s.db.Close()
+}
+
+// openRepairSource treats directories as backup roots and files as checksummer databases
+func openRepairSource(path string) (repairSource, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return rootSource(filepath.Clean(path)), nil
+	}
+
+	db, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	basepath, err := db.GetOption("basepath")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: not a checksummer database: %v", path, err)
+	}
+	return dbSource{db: db, basepath: basepath}, nil
+}
+
+// Repair restores changed files from a copy matching the originally recorded checksum
+func (db *DB) Repair(opts RepairOptions) error {
+	logger := log.New(os.Stdout, "repair: ", log.LstdFlags)
+
+	// get basepath
+	basepath, err := db.GetOption("basepath")
+	checkErr(err)
+
+	var sources []repairSource
+	for _, path := range opts.Sources {
+		source, err := openRepairSource(path)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+		sources = append(sources, source)
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("no backup roots or databases given")
+	}
+
+	rows, err := db.Query(`SELECT id, filename, checksum_sha256
+                            FROM files
+                            WHERE checksum_ok = '0'
+                            AND checksum_sha256 IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	var files []File
+	for rows.Next() {
+		var file File
+		err = rows.Scan(&file.ID, &file.Name, &file.Checksum)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		files = append(files, file)
+	}
+	rows.Close()
+
+	repaired, missing := 0, 0
+	for _, file := range files {
+		path := basepath + file.Name
+
+		good := findGoodCopy(sources, file, path, logger)
+		if good == "" {
+			logger.Printf("no good copy found for %s", path)
+			missing++
+			continue
+		}
+
+		target := path + opts.Suffix
+		if opts.DryRun {
+			logger.Printf("would restore %s from %s", target, good)
+			repaired++
+			continue
+		}
+
+		logger.Printf("restoring %s from %s", target, good)
+		err = restoreFile(good, target, file.Checksum)
+		if err != nil {
+			logger.Printf("restoring %s failed: %v", target, err)
+			missing++
+			continue
+		}
+
+		if opts.Suffix == "" {
+			fi, err := os.Stat(path)
+			checkErr(err)
+			_, err = db.Exec(`UPDATE files
+                                SET checksum_ok = 1, checked = ?, file_found = 1, filesize = ?, mtime = ?
+                                WHERE id = ?`, time.Now().Unix(), fi.Size(), fi.ModTime().Unix(), file.ID)
+			checkErr(err)
+			_, err = db.Exec("UPDATE chunks SET chunk_ok = 1 WHERE file_id = ?", file.ID)
+			checkErr(err)
+		}
+		logger.Printf("restored %s", target)
+		repaired++
+	}
+
+	if opts.DryRun {
+		logger.Printf("dry run: %v of %v files can be repaired", repaired, len(files))
+	} else {
+		logger.Printf("%v files repaired, %v could not be repaired", repaired, missing)
+	}
+	return nil
+}
+
+// findGoodCopy returns the first candidate whose content matches the recorded checksum
+func findGoodCopy(sources []repairSource, file File, path string, logger *log.Logger) string {
+	for _, source := range sources {
+		candidates, err := source.Candidates(file)
+		if err != nil {
+			logger.Printf("looking up %s: %v", path, err)
+			continue
+		}
+		for _, candidate := range candidates {
+			if candidate == path {
+				continue
+			}
+			fi, err := os.Stat(candidate)
+			if err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			hash, err := HashFile(candidate)
+			if err != nil {
+				logger.Printf("reading %s: %v", candidate, err)
+				continue
+			}
+			if hash != file.Checksum {
+				logger.Printf("skipping %s: checksum differs", candidate)
+				continue
+			}
+			return candidate
+		}
+	}
+	return ""
+}
+
+// restoreFile copies src over dst through a temporary file and verifies the result
+func restoreFile(src string, dst string, checksum string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := dst + ".checksummer-tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// read back what we have written before replacing anything
+	hash, err := HashFile(tmp)
+	if err != nil || hash != checksum {
+		os.Remove(tmp)
+		return fmt.Errorf("verification of %s failed", tmp)
+	}
+
+	err = os.Chtimes(tmp, fi.ModTime(), fi.ModTime())
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+func cmdRepair(db *DB, args []string) error {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "dry run, only show what would be restored")
+	suffix := flags.String("suffix", "", "restore alongside the bad file with this suffix")
+	flags.Parse(args)
+
+	return db.Repair(RepairOptions{Sources: flags.Args(), DryRun: *dryRun, Suffix: *suffix})
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSearchLimit caps the number of results of the search API
+const defaultSearchLimit = 1000
+
+// jobs are the operations that can be started over HTTP
+var jobs = map[string]func(db *DB){
+	"collect": func(db *DB) {
+		db.CollectFiles()
+		db.CheckFilesDB()
+	},
+	"checksums": func(db *DB) { db.MakeChecksums() },
+	"verify":    func(db *DB) { db.ReindexCheck(false) },
+}
+
+// Job is an operation started over HTTP
+type Job struct {
+	ID       int           `json:"id"`
+	Type     string        `json:"type"`
+	State    string        `json:"state"` // running, done or failed
+	Error    string        `json:"error,omitempty"`
+	Started  int64         `json:"started"`
+	Finished int64         `json:"finished,omitempty"`
+	Progress ProgressState `json:"progress"`
+}
+
+// server serves the web UI and the JSON API
+type server struct {
+	db    *DB
+	token string
+	mutex sync.Mutex
+	jobs  []*Job
+}
+
+// Serve starts the HTTP server. Reading endpoints are open, starting and
+// watching jobs needs the token as bearer token.
+func (db *DB) Serve(addr string, token string) error {
+	s := &server{db: db, token: token}
+
+	// progress of the running job, the server runs one job at a time
+	progressHook = func(state ProgressState) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if job := s.running(); job != nil {
+			job.Progress = state
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleIndex)
+	mux.HandleFunc("/api/search", s.handleSearch)
+	mux.HandleFunc("/api/stats", s.handleStats)
+	mux.HandleFunc("/api/duplicates", s.handleDuplicates)
+	mux.HandleFunc("/api/deleted", s.handleDeleted)
+	mux.HandleFunc("/api/changed", s.handleChanged)
+	mux.HandleFunc("/api/history", s.handleHistory)
+	mux.HandleFunc("/metrics", metricsHandler([]*DB{db}))
+	mux.HandleFunc("/api/jobs", s.authenticated(s.handleJobs))
+	mux.HandleFunc("/api/jobs/", s.authenticated(s.handleJob))
+
+	fmt.Printf("serving on http://%v/\n", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// running returns the job in progress, the caller holds the mutex
+func (s *server) running() *Job {
+	for _, job := range s.jobs {
+		if job.State == "running" {
+			return job
+		}
+	}
+	return nil
+}
+
+func (s *server) authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid or missing token"))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println("serve:", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// writeRecordsJSON writes records as a JSON array, never null
+func writeRecordsJSON(w http.ResponseWriter, records []Record, err error) {
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if records == nil {
+		records = []Record{}
+	}
+	writeJSON(w, records)
+}
+
+func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, webUI)
+}
+
+func (s *server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	limit := defaultSearchLimit
+	if l, err := strconv.Atoi(r.FormValue("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	records, err := s.db.SearchRecords(r.FormValue("q"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	writeRecordsJSON(w, records, nil)
+}
+
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	days := 30
+	if d, err := strconv.Atoi(r.FormValue("days")); err == nil && d > 0 {
+		days = d
+	}
+	stats, err := s.db.GetStats(days)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+func (s *server) handleDuplicates(w http.ResponseWriter, r *http.Request) {
+	groups, err := s.db.FindDuplicates(DuplicateOptions{Sort: r.FormValue("sort"), Dir: r.FormValue("dir")})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if groups == nil {
+		groups = []DuplicateGroup{}
+	}
+	writeJSON(w, groups)
+}
+
+func (s *server) handleDeleted(w http.ResponseWriter, r *http.Request) {
+	records, err := s.db.DeletedRecords()
+	writeRecordsJSON(w, records, err)
+}
+
+func (s *server) handleChanged(w http.ResponseWriter, r *http.Request) {
+	records, err := s.db.ChangedRecords()
+	writeRecordsJSON(w, records, err)
+}
+
+func (s *server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	path := r.FormValue("path")
+	if path == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("no path given"))
+		return
+	}
+	history, err := s.db.FileHistory(path)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, history)
+}
+
+// handleJobs lists jobs, or starts one on POST with the type as form value
+func (s *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		list := []Job{}
+		for _, job := range s.jobs {
+			list = append(list, *job)
+		}
+		writeJSON(w, list)
+	case http.MethodPost:
+		run, ok := jobs[r.FormValue("type")]
+		if !ok {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown job type %q, use collect, checksums or verify", r.FormValue("type")))
+			return
+		}
+		if running := s.running(); running != nil {
+			writeError(w, http.StatusConflict, fmt.Errorf("job %v is still running", running.ID))
+			return
+		}
+		err := s.db.Lock("serve " + r.FormValue("type"))
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		job := &Job{ID: len(s.jobs) + 1, Type: r.FormValue("type"), State: "running", Started: time.Now().Unix()}
+		s.jobs = append(s.jobs, job)
+		go s.runJob(job, run)
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, *job)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("use GET or POST"))
+	}
+}
+
+func (s *server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/jobs/"))
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err != nil || id < 1 || id > len(s.jobs) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such job"))
+		return
+	}
+	writeJSON(w, *s.jobs[id-1])
+}
+
+// runJob runs a job holding the write lock taken by handleJobs; the
+// operations panic on errors like the rest of checksummer
+func (s *server) runJob(job *Job, run func(db *DB)) {
+	defer func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		job.Finished = time.Now().Unix()
+		job.State = "done"
+		if err := recover(); err != nil {
+			job.State = "failed"
+			job.Error = fmt.Sprint(err)
+			log.Printf("serve: job %v failed: %v", job.ID, err)
+		}
+	}()
+	s.db.finishRun(func() error {
+		run(s.db)
+		return nil
+	})
+}
+
+func cmdServe(db *DB, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:8080", "address to listen on")
+	token := flags.String("token", os.Getenv("CHECKSUMMER_TOKEN"), "token needed to start jobs, default $CHECKSUMMER_TOKEN or a random one")
+	flags.Parse(args)
+
+	if *token == "" {
+		random := make([]byte, 16)
+		_, err := rand.Read(random)
+		if err != nil {
+			return err
+		}
+		*token = hex.EncodeToString(random)
+		fmt.Printf("token for starting jobs: %v\n", *token)
+	}
+	return db.Serve(*listen, *token)
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Snapshot is a named state of the file inventory at a point in time. Each
+// snapshot only stores the files that were added or changed since the
+// previous one, and a row with removed set for each file that is gone.
+type Snapshot struct {
+	ID      int64
+	Name    string
+	Created int64
+	Files   int64
+	Bytes   int64
+}
+
+// CreateSnapshot stores path, size, mtime and checksum of all found files under name
+func (db *DB) CreateSnapshot(name string) error {
+	if name == "" {
+		return fmt.Errorf("no snapshot name given")
+	}
+	_, err := db.getSnapshot(name)
+	if err == nil {
+		return fmt.Errorf("snapshot %q already exists", name)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO snapshots (name, created) VALUES (?, ?)", name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	var previous int64
+	err = tx.QueryRow("SELECT ifnull(max(id), 0) FROM snapshots WHERE id < ?", id).Scan(&previous)
+	if err != nil {
+		return err
+	}
+	before := snapshotInventory(previous)
+
+	res, err = tx.Exec(`INSERT INTO snapshot_files (snapshot_id, filename, filesize, mtime, checksum_sha256)
+                        SELECT ?, f.filename, f.filesize, f.mtime, f.checksum_sha256
+                        FROM files f
+                        LEFT JOIN `+before+` p ON p.filename = f.filename
+                        WHERE f.file_found = '1'
+                        AND (p.filename IS NULL
+                             OR p.filesize IS NOT f.filesize
+                             OR p.mtime IS NOT f.mtime
+                             OR p.checksum_sha256 IS NOT f.checksum_sha256)`, id)
+	if err != nil {
+		return err
+	}
+	changed, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	res, err = tx.Exec(`INSERT INTO snapshot_files (snapshot_id, filename, removed)
+                        SELECT ?, p.filename, 1
+                        FROM `+before+` p
+                        LEFT JOIN files f ON f.filename = p.filename AND f.file_found = '1'
+                        WHERE f.id IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	var files int
+	err = tx.QueryRow("SELECT count(*) FROM files WHERE file_found = '1'").Scan(&files)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("snapshot %v: %v files, %v added or changed and %v removed since the previous one\n",
+		name, thousandsSeparator(files), thousandsSeparator(int(changed)), thousandsSeparator(int(removed)))
+	return nil
+}
+
+// DeleteSnapshot removes a snapshot, the next one takes over its changes
+func (db *DB) DeleteSnapshot(name string) error {
+	snapshot, err := db.getSnapshot(name)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var previous, next int64
+	err = tx.QueryRow(`SELECT ifnull((SELECT max(id) FROM snapshots WHERE id < ?), 0),
+                              ifnull((SELECT min(id) FROM snapshots WHERE id > ?), 0)`,
+		snapshot.ID, snapshot.ID).Scan(&previous, &next)
+	if err != nil {
+		return err
+	}
+	if next != 0 {
+		_, err = tx.Exec(`INSERT INTO snapshot_files (snapshot_id, filename, filesize, mtime, checksum_sha256, removed)
+                          SELECT ?, filename, filesize, mtime, checksum_sha256, removed
+                          FROM snapshot_files
+                          WHERE snapshot_id = ?
+                          AND filename NOT IN (SELECT filename FROM snapshot_files WHERE snapshot_id = ?)`,
+			next, snapshot.ID, next)
+		if err != nil {
+			return err
+		}
+		if previous == 0 {
+			// the next one is the first now, nothing is removed before it
+			_, err = tx.Exec("DELETE FROM snapshot_files WHERE snapshot_id = ? AND removed = 1", next)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err = tx.Exec("DELETE FROM snapshot_files WHERE snapshot_id = ?", snapshot.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM snapshots WHERE id = ?", snapshot.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Snapshots returns all snapshots, oldest first
+func (db *DB) Snapshots() ([]Snapshot, error) {
+	rows, err := db.Query("SELECT id, name, created FROM snapshots ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snapshots []Snapshot
+	for rows.Next() {
+		var s Snapshot
+		err = rows.Scan(&s.ID, &s.Name, &s.Created)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, s)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range snapshots {
+		var bytes float64
+		err = db.QueryRow("SELECT count(*), total(filesize) FROM "+snapshotInventory(snapshots[i].ID)).Scan(&snapshots[i].Files, &bytes)
+		if err != nil {
+			return nil, err
+		}
+		snapshots[i].Bytes = int64(bytes)
+	}
+	return snapshots, nil
+}
+
+// ListSnapshots prints all snapshots
+func (db *DB) ListSnapshots() error {
+	snapshots, err := db.Snapshots()
+	if err != nil {
+		return err
+	}
+	var buffer bytes.Buffer
+	for _, s := range snapshots {
+		created := time.Unix(s.Created, 0).Format("2006-01-02 15:04:05")
+		buffer.WriteString(fmt.Sprintf("%v  %10v files  %10v    %v\n", created, thousandsSeparator(int(s.Files)), ByteSize(s.Bytes), s.Name))
+	}
+	if len(snapshots) == 0 {
+		buffer.WriteString("no snapshots yet\n")
+	}
+	pager(buffer.String())
+	return nil
+}
+
+func (db *DB) getSnapshot(name string) (Snapshot, error) {
+	var s Snapshot
+	err := db.QueryRow("SELECT id, name, created FROM snapshots WHERE name = ?", name).Scan(&s.ID, &s.Name, &s.Created)
+	if err != nil {
+		return s, fmt.Errorf("no snapshot %q", name)
+	}
+	return s, nil
+}
+
+// inventory returns a subquery selecting the files of a snapshot,
+// or of the current state of the database when name is empty
+func (db *DB) inventory(name string) (string, error) {
+	if name == "" {
+		return `(SELECT filename, filesize, mtime, checksum_sha256 FROM files WHERE file_found = '1')`, nil
+	}
+	snapshot, err := db.getSnapshot(name)
+	if err != nil {
+		return "", err
+	}
+	return snapshotInventory(snapshot.ID), nil
+}
+
+// snapshotInventory returns a subquery selecting the files of the snapshot
+// with the given id: the latest row of each file up to it, unless that
+// records the removal. SQLite takes the other columns from the row with
+// the max(snapshot_id).
+func snapshotInventory(id int64) string {
+	return fmt.Sprintf(`(SELECT filename, filesize, mtime, checksum_sha256
+                         FROM (SELECT filename, filesize, mtime, checksum_sha256, removed, max(snapshot_id)
+                               FROM snapshot_files
+                               WHERE snapshot_id <= %d
+                               GROUP BY filename)
+                         WHERE removed = 0)`, id)
+}
+
+// DiffSnapshots lists files added, removed, modified and moved between two
+// snapshots. An empty name stands for the current state of the database.
+func (db *DB) DiffSnapshots(from string, to string) error {
+	a, err := db.inventory(from)
+	if err != nil {
+		return err
+	}
+	b, err := db.inventory(to)
+	if err != nil {
+		return err
+	}
+
+	added, err := db.queryRecords(`SELECT 0, b.filename, b.filesize, b.mtime, b.checksum_sha256
+                                    FROM ` + b + ` b
+                                    LEFT JOIN ` + a + ` a ON a.filename = b.filename
+                                    WHERE a.filename IS NULL
+                                    ORDER BY b.filename`)
+	if err != nil {
+		return err
+	}
+	removed, err := db.queryRecords(`SELECT 0, a.filename, a.filesize, a.mtime, a.checksum_sha256
+                                      FROM ` + a + ` a
+                                      LEFT JOIN ` + b + ` b ON b.filename = a.filename
+                                      WHERE b.filename IS NULL
+                                      ORDER BY a.filename`)
+	if err != nil {
+		return err
+	}
+	modified, err := db.queryRecords(`SELECT 0, b.filename, b.filesize, b.mtime, b.checksum_sha256
+                                       FROM ` + b + ` b
+                                       JOIN ` + a + ` a ON a.filename = b.filename
+                                       WHERE a.filesize IS NOT b.filesize
+                                       OR a.mtime IS NOT b.mtime
+                                       OR a.checksum_sha256 IS NOT b.checksum_sha256
+                                       ORDER BY b.filename`)
+	if err != nil {
+		return err
+	}
+
+	// a removed and an added file with the same content were moved
+	removedByChecksum := make(map[string][]int)
+	for i, r := range removed {
+		if r.Checksum != "" {
+			removedByChecksum[r.Checksum] = append(removedByChecksum[r.Checksum], i)
+		}
+	}
+	moved := make(map[int]bool)
+	var records []Record
+	for _, r := range added {
+		candidates := removedByChecksum[r.Checksum]
+		if r.Checksum != "" && len(candidates) > 0 {
+			i := candidates[0]
+			removedByChecksum[r.Checksum] = candidates[1:]
+			moved[i] = true
+			r.Source = removed[i].Path
+			r.Status = "moved"
+		} else {
+			r.Status = "added"
+		}
+		records = append(records, r)
+	}
+	for i, r := range removed {
+		if !moved[i] {
+			r.Status = "removed"
+			records = append(records, r)
+		}
+	}
+	for _, r := range modified {
+		r.Status = "modified"
+		records = append(records, r)
+	}
+
+	if outputFormat != "text" {
+		return writeRecords(records, nil)
+	}
+
+	type total struct {
+		files int
+		bytes int64
+	}
+	totals := make(map[string]*total)
+	var buffer bytes.Buffer
+	for _, status := range []string{"added", "removed", "modified", "moved"} {
+		totals[status] = &total{}
+		for _, r := range records {
+			if r.Status != status {
+				continue
+			}
+			totals[status].files++
+			totals[status].bytes += r.Size
+			if status == "moved" {
+				buffer.WriteString(fmt.Sprintf("%-8v  %10v    %v -> %v\n", status, ByteSize(r.Size), r.Source, r.Path))
+			} else {
+				buffer.WriteString(fmt.Sprintf("%-8v  %10v    %v\n", status, ByteSize(r.Size), r.Path))
+			}
+		}
+	}
+	var summary []string
+	for _, status := range []string{"added", "removed", "modified", "moved"} {
+		summary = append(summary, fmt.Sprintf("%v: %v files, %v", status, totals[status].files, ByteSize(totals[status].bytes)))
+	}
+	buffer.WriteString(strings.Join(summary, "   ") + "\n")
+	pager(buffer.String())
+	return nil
+}
+
+// HistoryEntry is the state of a file in a snapshot
+type HistoryEntry struct {
+	Snapshot string `json:"snapshot"`
+	Created  int64  `json:"created"`
+	Size     int64  `json:"size"`
+	Mtime    int64  `json:"mtime"`
+	Checksum string `json:"checksum"`
+}
+
+// FileHistory returns the state of a file in every snapshot that contains it,
+// followed by its current state if it is still found
+func (db *DB) FileHistory(path string) ([]HistoryEntry, error) {
+
+	// get basepath
+	basepath, err := db.GetOption("basepath")
+	checkErr(err)
+
+	filename := normalizeSelection(basepath, []string{path})[0]
+	rows, err := db.Query(`SELECT s.name, s.created, f.filesize, f.mtime, f.checksum_sha256
+                           FROM snapshots s
+                           JOIN snapshot_files f ON f.filename = ? AND f.snapshot_id =
+                                (SELECT max(snapshot_id) FROM snapshot_files WHERE filename = ? AND snapshot_id <= s.id)
+                           WHERE f.removed = 0
+                           UNION ALL
+                           SELECT '', strftime('%s', 'now'), filesize, mtime, checksum_sha256
+                           FROM files
+                           WHERE filename = ? AND file_found = '1'
+                           ORDER BY 2`, filename, filename, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []HistoryEntry{}
+	for rows.Next() {
+		var (
+			h        HistoryEntry
+			filesize sql.NullInt64
+			mtime    sql.NullFloat64
+			checksum sql.NullString
+		)
+		err = rows.Scan(&h.Snapshot, &h.Created, &filesize, &mtime, &checksum)
+		if err != nil {
+			return nil, err
+		}
+		h.Size = filesize.Int64
+		h.Mtime = int64(mtime.Float64)
+		h.Checksum = checksum.String
+		history = append(history, h)
+	}
+	return history, rows.Err()
+}
+
+func cmdSnapshot(db *DB, args []string) error {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	list := flags.Bool("list", false, "list snapshots")
+	del := flags.Bool("delete", false, "delete the snapshot")
+	flags.Parse(args)
+
+	switch {
+	case *list:
+		return db.ListSnapshots()
+	case *del:
+		return db.DeleteSnapshot(flags.Arg(0))
+	}
+	return db.CreateSnapshot(flags.Arg(0))
+}
+
+func cmdDiff(db *DB, args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	format := formatFlag(flags)
+	flags.Parse(args)
+	err := setFormat(*format)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return fmt.Errorf("usage: diff SNAPSHOT [SNAPSHOT]")
+	}
+
+	// without a second snapshot, compare with the current state
+	return db.DiffSnapshots(flags.Arg(0), flags.Arg(1))
+}
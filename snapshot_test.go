@@ -0,0 +1,91 @@
+package main
+
+import "testing"
+
+// snapshotFiles returns the number of files of each snapshot, by name
+func snapshotFiles(t *testing.T, db *DB) map[string]int64 {
+	snapshots, err := db.Snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]int64)
+	for _, s := range snapshots {
+		files[s.Name] = s.Files
+	}
+	return files
+}
+
+func TestSnapshotsStoreChanges(t *testing.T) {
+	db := testDB(t, "/a", "/b", "/c")
+	err := db.CreateSnapshot("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, statement := range []string{
+		"UPDATE files SET checksum_sha256 = 'new' WHERE filename = '/b'",
+		"UPDATE files SET file_found = 0 WHERE filename = '/c'",
+		"INSERT INTO files(filename, filesize, mtime, file_found) VALUES('/d', 1, 1, 1)",
+	} {
+		_, err = db.Exec(statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.CreateSnapshot("s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// b changed, c removed, d added; a is taken from s1
+	rows, err := db.GetCount("SELECT count(*) FROM snapshot_files WHERE snapshot_id = (SELECT id FROM snapshots WHERE name = 's2')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 3 {
+		t.Errorf("s2 stores %v rows, want 3", rows)
+	}
+	files := snapshotFiles(t, db)
+	if files["s1"] != 3 || files["s2"] != 3 {
+		t.Errorf("files of the snapshots: %v", files)
+	}
+
+	history, err := db.FileHistory("/data/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Snapshot != "s1" {
+		t.Errorf("history of c: %+v", history)
+	}
+	history, err = db.FileHistory("/data/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[0].Checksum != "" || history[1].Checksum != "new" || history[2].Snapshot != "" {
+		t.Errorf("history of b: %+v", history)
+	}
+
+	// s2 takes over the files of s1 it does not store itself
+	err = db.DeleteSnapshot("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = snapshotFiles(t, db)
+	if len(files) != 1 || files["s2"] != 3 {
+		t.Errorf("files of the snapshots after deleting s1: %v", files)
+	}
+	removed, err := db.GetCount("SELECT count(*) FROM snapshot_files WHERE removed = 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 {
+		t.Errorf("%v removals left in the first snapshot", removed)
+	}
+	history, err = db.FileHistory("/data/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Snapshot != "s2" {
+		t.Errorf("history of a: %+v", history)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// statsTop is how many extensions and directories are listed
+const statsTop = 15
+
+// StatsBucket is the number of files and bytes of one row of a breakdown
+type StatsBucket struct {
+	Name  string `json:"name"`
+	Files int64  `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// Stats summarises the files in the database
+type Stats struct {
+	Basepath     string        `json:"basepath"`
+	Files        int64         `json:"files"`
+	Bytes        int64         `json:"bytes"`
+	Deleted      int64         `json:"deleted"`
+	Changed      int64         `json:"changed"`
+	Hashed       int64         `json:"hashed"`
+	Verified     int64         `json:"verified"`
+	VerifiedDays int           `json:"verified_days"`
+	Extensions   []StatsBucket `json:"extensions"`
+	Years        []StatsBucket `json:"years"`
+	Sizes        []StatsBucket `json:"sizes"`
+	Directories  []StatsBucket `json:"directories"`
+}
+
+// statsSizes are the upper bounds of the size buckets
+var statsSizes = []struct {
+	name  string
+	limit int64
+}{
+	{"empty", 1},
+	{"< 4KB", 4 << 10},
+	{"< 64KB", 64 << 10},
+	{"< 1MB", 1 << 20},
+	{"< 16MB", 16 << 20},
+	{"< 256MB", 256 << 20},
+	{"< 1GB", 1 << 30},
+	{"< 16GB", 16 << 30},
+}
+
+// queryBuckets runs a statement selecting name, file count and bytes
+func (db *DB) queryBuckets(statement string, args ...interface{}) ([]StatsBucket, error) {
+	rows, err := db.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []StatsBucket{}
+	for rows.Next() {
+		var b StatsBucket
+		var bytes float64 // sum() is a float for python populated databases
+		err = rows.Scan(&b.Name, &b.Files, &bytes)
+		if err != nil {
+			return nil, err
+		}
+		b.Bytes = int64(bytes)
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// GetStats computes the statistics of found files. Verified counts files
+// whose checksum was confirmed in the last days.
+func (db *DB) GetStats(days int) (*Stats, error) {
+	s := &Stats{VerifiedDays: days}
+	since := time.Now().AddDate(0, 0, -days).Unix()
+
+	err := db.QueryRow(`SELECT count(id),
+                               ifnull(sum(filesize), 0),
+                               ifnull(sum(checksum_sha256 IS NOT NULL), 0),
+                               ifnull(sum(checksum_ok = 1 AND checked >= ?), 0)
+                        FROM files
+                        WHERE file_found = '1'`, since).Scan(&s.Files, &s.Bytes, &s.Hashed, &s.Verified)
+	if err != nil {
+		return nil, err
+	}
+	err = db.QueryRow(`SELECT ifnull(sum(file_found = '0'), 0),
+                               ifnull(sum(checksum_ok = '0'), 0)
+                        FROM files`).Scan(&s.Deleted, &s.Changed)
+	if err != nil {
+		return nil, err
+	}
+
+	// the extension is what follows the last dot of the name after the last slash
+	s.Extensions, err = db.queryBuckets(`SELECT CASE WHEN instr(name, '.') > 1
+                                                   THEN lower(replace(name, rtrim(name, replace(name, '.', '')), ''))
+                                                   ELSE '' END AS ext,
+                                              count(*), ifnull(sum(filesize), 0)
+                                       FROM (SELECT replace(filename, rtrim(filename, replace(filename, '/', '')), '') AS name, filesize
+                                             FROM files
+                                             WHERE file_found = '1')
+                                       GROUP BY ext
+                                       ORDER BY sum(filesize) DESC
+                                       LIMIT ?`, statsTop)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Years, err = db.queryBuckets(`SELECT ifnull(strftime('%Y', mtime, 'unixepoch', 'localtime'), 'unknown') AS year,
+                                         count(id), ifnull(sum(filesize), 0)
+                                  FROM files
+                                  WHERE file_found = '1'
+                                  GROUP BY year
+                                  ORDER BY year`)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket := "CASE"
+	for i, size := range statsSizes {
+		bucket += fmt.Sprintf(" WHEN filesize < %d THEN %d", size.limit, i)
+	}
+	bucket += fmt.Sprintf(" ELSE %d END", len(statsSizes))
+	s.Sizes, err = db.queryBuckets(`SELECT ` + bucket + ` AS bucket, count(id), ifnull(sum(filesize), 0)
+                                  FROM files
+                                  WHERE file_found = '1'
+                                  GROUP BY bucket
+                                  ORDER BY bucket`)
+	if err != nil {
+		return nil, err
+	}
+	for i := range s.Sizes {
+		var n int
+		fmt.Sscan(s.Sizes[i].Name, &n)
+		if n < len(statsSizes) {
+			s.Sizes[i].Name = statsSizes[n].name
+		} else {
+			s.Sizes[i].Name = fmt.Sprintf(">= %v", ByteSize(statsSizes[len(statsSizes)-1].limit))
+		}
+	}
+
+	// get basepath
+	basepath, err := db.GetOption("basepath")
+	checkErr(err)
+
+	s.Directories, err = db.queryBuckets(`SELECT CASE WHEN instr(substr(filename, 2), '/') > 0
+                                                    THEN substr(filename, 1, instr(substr(filename, 2), '/'))
+                                                    ELSE '/' END AS dir,
+                                               count(id), ifnull(sum(filesize), 0)
+                                        FROM files
+                                        WHERE file_found = '1'
+                                        GROUP BY dir
+                                        ORDER BY sum(filesize) DESC
+                                        LIMIT ?`, statsTop)
+	if err != nil {
+		return nil, err
+	}
+	s.Basepath = basepath
+	for i := range s.Directories {
+		s.Directories[i].Name = basepath + s.Directories[i].Name
+	}
+
+	return s, nil
+}
+
+// ShowStats prints the statistics as text or JSON
+func (db *DB) ShowStats(days int) error {
+	s, err := db.GetStats(days)
+	if err != nil {
+		return err
+	}
+
+	switch outputFormat {
+	case "json", "jsonl":
+		out, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	case "text":
+	default:
+		return fmt.Errorf("statistics can only be written as text or json")
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("%v files, %v\n", thousandsSeparator(int(s.Files)), ByteSize(s.Bytes)))
+	buffer.WriteString(fmt.Sprintf("hashed:   %10v  %5.1f%%\n", thousandsSeparator(int(s.Hashed)), percentOf(s.Hashed, s.Files)))
+	buffer.WriteString(fmt.Sprintf("verified: %10v  %5.1f%%  in the last %v days\n", thousandsSeparator(int(s.Verified)), percentOf(s.Verified, s.Files), s.VerifiedDays))
+	buffer.WriteString(fmt.Sprintf("deleted:  %10v\n", thousandsSeparator(int(s.Deleted))))
+	buffer.WriteString(fmt.Sprintf("changed:  %10v\n", thousandsSeparator(int(s.Changed))))
+
+	sections := []struct {
+		title   string
+		buckets []StatsBucket
+	}{
+		{"by extension", s.Extensions},
+		{"by modification year", s.Years},
+		{"by size", s.Sizes},
+		{"largest directories", s.Directories},
+	}
+	for _, section := range sections {
+		buffer.WriteString(fmt.Sprintf("\n%v\n", section.title))
+		for _, b := range section.buckets {
+			name := b.Name
+			if name == "" {
+				name = "(none)"
+			}
+			buffer.WriteString(fmt.Sprintf("    %10v files  %10v  %5.1f%%    %v\n", thousandsSeparator(int(b.Files)), ByteSize(b.Bytes),
+				percentOf(b.Bytes, s.Bytes), name))
+		}
+	}
+	pager(buffer.String())
+	return nil
+}
+
+func cmdStats(db *DB, args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	format := flags.String("format", outputFormat, "output format: text or json")
+	days := flags.Int("days", 30, "count files verified within this many days")
+	flags.Parse(args)
+	err := setFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	return db.ShowStats(*days)
+}
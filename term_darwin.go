@@ -0,0 +1,11 @@
+//go:build darwin
+// +build darwin
+
+package main
+
+import "syscall"
+
+const (
+	ioctlGetTermios = syscall.TIOCGETA
+	ioctlSetTermios = syscall.TIOCSETA
+)
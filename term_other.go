@@ -0,0 +1,25 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// isTerminal reports false, the menu and the listings fall back to line
+// based input and output
+func isTerminal(f *os.File) bool {
+	return false
+}
+
+// terminalSize returns the size of a classic terminal
+func terminalSize() (rows int, cols int) {
+	return 24, 80
+}
+
+// makeRaw is only implemented for Linux and macOS
+func makeRaw() (restore func(), err error) {
+	return nil, errors.New("raw terminal input is not supported on this platform")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+)
+
+// keys returned by readKey besides printable characters
+const (
+	keyNone = iota
+	keyRune
+	keyEnter
+	keyEsc
+	keyBackspace
+	keyUp
+	keyDown
+	keyLeft
+	keyRight
+	keyPgUp
+	keyPgDown
+	keyHome
+	keyEnd
+	keyInterrupt // Ctrl-C, which raw mode does not turn into SIGINT
+)
+
+// ANSI escape sequences
+const (
+	altScreenOn   = "\033[?1049h"
+	altScreenOff  = "\033[?1049l"
+	cursorHide    = "\033[?25l"
+	cursorShow    = "\033[?25h"
+	clearAll      = "\033[H\033[2J"
+	clearLine     = "\033[2K"
+	reverseOn     = "\033[7m"
+	boldOn        = "\033[1m"
+	attributesOff = "\033[0m"
+)
+
+// pending holds typed or pasted characters not yet returned by readKey
+var pending []rune
+
+// readKey reads a single keypress from stdin in raw mode
+func readKey() (key int, r rune) {
+	if len(pending) > 0 {
+		r, pending = pending[0], pending[1:]
+		return keyRune, r
+	}
+
+	var buf [64]byte
+	n, err := os.Stdin.Read(buf[:])
+	if err != nil || n == 0 {
+		return keyEsc, 0
+	}
+	b := buf[:n]
+
+	switch {
+	case b[0] == '\r' || b[0] == '\n':
+		return keyEnter, 0
+	case b[0] == 127 || b[0] == 8:
+		return keyBackspace, 0
+	case b[0] == 3:
+		return keyInterrupt, 0
+	case b[0] == 27 && n == 1:
+		return keyEsc, 0
+	case b[0] == 27 && n >= 3 && (b[1] == '[' || b[1] == 'O'):
+		switch string(b[2:]) {
+		case "A":
+			return keyUp, 0
+		case "B":
+			return keyDown, 0
+		case "C":
+			return keyRight, 0
+		case "D":
+			return keyLeft, 0
+		case "5~":
+			return keyPgUp, 0
+		case "6~":
+			return keyPgDown, 0
+		case "H", "1~", "7~":
+			return keyHome, 0
+		case "F", "4~", "8~":
+			return keyEnd, 0
+		}
+		return keyNone, 0
+	case b[0] < 32:
+		return keyNone, 0
+	}
+
+	for _, c := range string(b) {
+		if c >= 32 && c != 127 {
+			pending = append(pending, c)
+		}
+	}
+	if len(pending) == 0 {
+		return keyNone, 0
+	}
+	r, pending = pending[0], pending[1:]
+	return keyRune, r
+}
+
+// minInt returns the smaller of a and b
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// truncate cuts s to at most width runes
+func truncate(s string, width int) string {
+	r := []rune(s)
+	if len(r) > width {
+		return string(r[:width])
+	}
+	return s
+}
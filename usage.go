@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// usageEntry is a subdirectory or a file shown in the disk usage browser
+type usageEntry struct {
+	name  string
+	size  int64
+	count int
+	dir   *dirNode
+}
+
+// sortedDirs returns the subdirectories of d, largest first
+func (d *dirNode) sortedDirs() []*dirNode {
+	var dirs []*dirNode
+	for _, sub := range d.dirs {
+		dirs = append(dirs, sub)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if dirs[i].size != dirs[j].size {
+			return dirs[i].size > dirs[j].size
+		}
+		return dirs[i].path < dirs[j].path
+	})
+	return dirs
+}
+
+// entries returns the subdirectories and files of d, largest first
+func (d *dirNode) entries() []usageEntry {
+	var entries []usageEntry
+	for name, sub := range d.dirs {
+		entries = append(entries, usageEntry{name: name + "/", size: sub.size, count: sub.count, dir: sub})
+	}
+	for name, r := range d.files {
+		entries = append(entries, usageEntry{name: name, size: r.Size, count: 1})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].size != entries[j].size {
+			return entries[i].size > entries[j].size
+		}
+		return entries[i].name < entries[j].name
+	})
+	return entries
+}
+
+// percentOf returns part in percent of total
+func percentOf(part int64, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) * 100 / float64(total)
+}
+
+// usageRoot loads the directory tree from the database and returns the given directory
+func (db *DB) usageRoot(dir string) (*dirNode, string, error) {
+
+	// get basepath
+	basepath, err := db.GetOption("basepath")
+	checkErr(err)
+
+	dirs, err := db.loadDirectoryTree()
+	if err != nil {
+		return nil, "", err
+	}
+	start := "/"
+	if dir != "" {
+		start = normalizeSelection(basepath, []string{dir})[0]
+	}
+	root, ok := dirs[start]
+	if !ok {
+		return nil, "", fmt.Errorf("no files below %v", basepath+start)
+	}
+	return root, basepath, nil
+}
+
+// DiskUsage lists the total size and file count of dir and its subdirectories
+// down to depth levels, largest first. Only the database is read, not the disk.
+func (db *DB) DiskUsage(dir string, depth int) error {
+	root, basepath, err := db.usageRoot(dir)
+	if err != nil {
+		return err
+	}
+
+	var records []Record
+	var buffer bytes.Buffer
+	var walk func(d *dirNode, level int)
+	walk = func(d *dirNode, level int) {
+		records = append(records, Record{Path: basepath + d.path, Size: d.size, Count: int64(d.count)})
+		buffer.WriteString(fmt.Sprintf("%10v %6.1f%% %10v files  %v%v\n", ByteSize(d.size), percentOf(d.size, root.size),
+			thousandsSeparator(d.count), strings.Repeat("  ", level), basepath+d.path))
+		if level < depth {
+			for _, sub := range d.sortedDirs() {
+				walk(sub, level+1)
+			}
+		}
+	}
+	walk(root, 0)
+
+	if outputFormat != "text" {
+		return writeRecords(records, nil)
+	}
+	pager(buffer.String())
+	return nil
+}
+
+// BrowseDiskUsage lets the user walk through the directory tree by size.
+// When not on a terminal, the first level is listed instead.
+func (db *DB) BrowseDiskUsage(dir string) error {
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return db.DiskUsage(dir, 1)
+	}
+
+	root, basepath, err := db.usageRoot(dir)
+	if err != nil {
+		return err
+	}
+
+	restore, err := makeRaw()
+	if err != nil {
+		return err
+	}
+	defer restore()
+	if !inTUI {
+		fmt.Print(altScreenOn)
+		defer fmt.Print(altScreenOff + cursorShow)
+	}
+
+	current := root
+	entries := current.entries()
+	cursor, offset := 0, 0
+	for {
+		rows, cols := terminalSize()
+		height := rows - 2
+		if cursor >= len(entries) {
+			cursor = len(entries) - 1
+		}
+		if cursor < 0 {
+			cursor = 0
+		}
+		if cursor < offset {
+			offset = cursor
+		}
+		if cursor >= offset+height {
+			offset = cursor - height + 1
+		}
+
+		var buf bytes.Buffer
+		buf.WriteString(cursorHide + clearAll)
+		header := fmt.Sprintf(" %v   %v in %v files", basepath+current.path, ByteSize(current.size), thousandsSeparator(current.count))
+		buf.WriteString(reverseOn + fmt.Sprintf("%-*s", cols, truncate(header, cols)) + attributesOff + "\r\n")
+		for i := offset; i < offset+height; i++ {
+			if i < len(entries) {
+				e := entries[i]
+				files := ""
+				if e.dir != nil {
+					files = thousandsSeparator(e.count) + " files"
+				}
+				line := truncate(fmt.Sprintf("%10v %6.1f%% %16v  %v", ByteSize(e.size), percentOf(e.size, current.size), files, e.name), cols)
+				if i == cursor {
+					line = reverseOn + line + attributesOff
+				}
+				buf.WriteString(line)
+			}
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString(truncate(" ↑↓ select   Enter → open   ← Backspace up   q back", cols))
+		os.Stdout.Write(buf.Bytes())
+
+		key, r := readKey()
+		switch {
+		case key == keyUp || r == 'k':
+			cursor--
+		case key == keyDown || r == 'j':
+			cursor++
+		case key == keyPgUp:
+			cursor -= height
+		case key == keyPgDown:
+			cursor += height
+		case key == keyHome:
+			cursor = 0
+		case key == keyEnd:
+			cursor = len(entries) - 1
+		case key == keyEnter || key == keyRight || r == 'l':
+			if cursor < len(entries) && entries[cursor].dir != nil {
+				current = entries[cursor].dir
+				entries = current.entries()
+				cursor, offset = 0, 0
+			}
+		case key == keyLeft || key == keyBackspace || r == 'h':
+			if current != root {
+				from := current
+				current = current.parent
+				entries = current.entries()
+				cursor, offset = 0, 0
+				for i, e := range entries {
+					if e.dir == from {
+						cursor = i
+					}
+				}
+			}
+		case key == keyEsc || key == keyInterrupt || r == 'q':
+			return nil
+		}
+	}
+}
+
+func cmdDiskUsage(db *DB, args []string) error {
+	flags := flag.NewFlagSet("du", flag.ExitOnError)
+	format := formatFlag(flags)
+	depth := flags.Int("depth", 1, "list subdirectories down to this depth")
+	interactive := flags.Bool("i", false, "browse the directory tree interactively")
+	flags.Parse(args)
+	err := setFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	dir := ""
+	if flags.NArg() > 0 {
+		dir = flags.Arg(0)
+	}
+	if *interactive {
+		return db.BrowseDiskUsage(dir)
+	}
+	return db.DiskUsage(dir, *depth)
+}
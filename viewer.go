@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// viewer is a scrollable, filterable list of result lines
+type viewer struct {
+	lines     []string
+	visible   []string
+	offset    int
+	filter    string
+	filtering bool
+}
+
+func (v *viewer) applyFilter() {
+	if v.filter == "" {
+		v.visible = v.lines
+		return
+	}
+	v.visible = nil
+	term := strings.ToLower(v.filter)
+	for _, line := range v.lines {
+		if strings.Contains(strings.ToLower(line), term) {
+			v.visible = append(v.visible, line)
+		}
+	}
+	v.offset = 0
+}
+
+func (v *viewer) draw() {
+	rows, cols := terminalSize()
+	height := rows - 2
+
+	// keep the offset within bounds after filtering or resizing
+	if v.offset > len(v.visible)-height {
+		v.offset = len(v.visible) - height
+	}
+	if v.offset < 0 {
+		v.offset = 0
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(clearAll)
+
+	header := fmt.Sprintf(" %s lines", thousandsSeparator(len(v.visible)))
+	if v.filter != "" {
+		header += fmt.Sprintf(" matching %q", v.filter)
+	}
+	if len(v.visible) > height {
+		header += fmt.Sprintf(" (%v-%v)", v.offset+1, minInt(v.offset+height, len(v.visible)))
+	}
+	buf.WriteString(reverseOn + fmt.Sprintf("%-*s", cols, truncate(header, cols)) + attributesOff + "\r\n")
+
+	for i := 0; i < height; i++ {
+		if v.offset+i < len(v.visible) {
+			buf.WriteString(truncate(v.visible[v.offset+i], cols))
+		}
+		buf.WriteString("\r\n")
+	}
+
+	if v.filtering {
+		buf.WriteString(cursorShow + "/" + v.filter)
+	} else {
+		buf.WriteString(cursorHide + truncate(" ↑↓ PgUp PgDn Home End scroll   / filter   q back", cols))
+	}
+	os.Stdout.Write(buf.Bytes())
+}
+
+// handle processes a keypress and returns false when the viewer should close
+func (v *viewer) handle(key int, r rune) bool {
+	rows, _ := terminalSize()
+	page := rows - 3
+
+	if v.filtering {
+		switch key {
+		case keyInterrupt:
+			return false
+		case keyEnter:
+			v.filtering = false
+		case keyEsc:
+			v.filtering = false
+			v.filter = ""
+			v.applyFilter()
+		case keyBackspace:
+			if v.filter != "" {
+				f := []rune(v.filter)
+				v.filter = string(f[:len(f)-1])
+				v.applyFilter()
+			}
+		case keyRune:
+			v.filter += string(r)
+			v.applyFilter()
+		}
+		return true
+	}
+
+	switch {
+	case key == keyUp || r == 'k':
+		v.offset--
+	case key == keyDown || r == 'j':
+		v.offset++
+	case key == keyPgUp || r == 'b':
+		v.offset -= page
+	case key == keyPgDown || r == ' ':
+		v.offset += page
+	case key == keyHome || r == 'g':
+		v.offset = 0
+	case key == keyEnd || r == 'G':
+		v.offset = len(v.visible)
+	case r == '/':
+		v.filtering = true
+	case key == keyEsc && v.filter != "":
+		v.filter = ""
+		v.applyFilter()
+	case key == keyEsc || key == keyInterrupt || r == 'q':
+		return false
+	}
+	return true
+}
+
+// pager shows the output in the viewer, or prints it when not on a terminal
+func pager(str string) {
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		fmt.Print(str)
+		return
+	}
+
+	restore, err := makeRaw()
+	if err != nil {
+		fmt.Print(str)
+		return
+	}
+	defer restore()
+	if !inTUI {
+		fmt.Print(altScreenOn)
+		defer fmt.Print(altScreenOff + cursorShow)
+	}
+
+	v := &viewer{lines: strings.Split(strings.TrimRight(str, "\n"), "\n")}
+	if str == "" {
+		v.lines = nil
+	}
+	v.applyFilter()
+	for {
+		v.draw()
+		key, r := readKey()
+		if !v.handle(key, r) {
+			return
+		}
+	}
+}
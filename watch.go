@@ -0,0 +1,460 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// kinds of watchEvent
+const (
+	watchCreate = iota
+	watchWrite
+	watchRemove
+	watchMovedFrom
+	watchMovedTo
+	watchOverflow
+)
+
+// watchEvent is a change in the tree reported by the watcher
+type watchEvent struct {
+	op     int
+	path   string
+	dir    bool
+	cookie uint32 // pairs watchMovedFrom with watchMovedTo
+}
+
+// errWatchLimit is returned when no more directories can be watched
+var errWatchLimit = errors.New("inotify watch limit reached, see fs.inotify.max_user_watches")
+
+// movedFrom is a rename waiting for its target
+type movedFrom struct {
+	path string
+	dir  bool
+	at   time.Time
+}
+
+// pathChange is a removal or, with a target, a rename waiting to be applied
+type pathChange struct {
+	from string
+	to   string
+}
+
+// WatchOptions control the watch mode
+type WatchOptions struct {
+	Settle time.Duration // quiet time before a changed file is hashed
+	Rescan time.Duration // interval of the rescans when the tree cannot be watched
+}
+
+// forgetFile removes a file with its chunks and parity from the database
+func (db *DB) forgetFile(id int64) error {
+	_, err := db.Exec("DELETE FROM chunks WHERE file_id = ?", id)
+	if err != nil {
+		return err
+	}
+	err = db.pruneParity(fmt.Sprintf("id = %d", id))
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM files WHERE id = ?", id)
+	return err
+}
+
+// markMissing marks a file, or all files below a directory, as not found
+// and returns how many there were
+func (db *DB) markMissing(rel string) (int64, error) {
+	result, err := db.Exec(`UPDATE files
+                            SET file_found = 0
+                            WHERE file_found = 1
+                            AND (filename = ? OR filename LIKE ? ESCAPE '\')`, rel, escapeLike(rel)+"/%")
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// renamePath moves the entries of a renamed file or directory, keeping
+// their checksums. It returns false if there were none.
+func (db *DB) renamePath(from string, to string) (bool, error) {
+
+	// entries of files that were replaced by the rename
+	ids, err := db.queryIDs(`SELECT id FROM files
+                             WHERE filename = ?
+                             OR filename LIKE ? ESCAPE '\'`, to, escapeLike(to)+"/%")
+	if err != nil {
+		return false, err
+	}
+	for _, id := range ids {
+		err = db.forgetFile(id)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	result, err := db.Exec("UPDATE files SET filename = ? WHERE filename = ?", to, from)
+	if err != nil {
+		return false, err
+	}
+	files, _ := result.RowsAffected()
+	result, err = db.Exec(`UPDATE files
+                           SET filename = ? || substr(filename, ?)
+                           WHERE filename LIKE ? ESCAPE '\'`, to, len(from)+1, escapeLike(from)+"/%")
+	if err != nil {
+		return false, err
+	}
+	children, _ := result.RowsAffected()
+	return files+children > 0, nil
+}
+
+// queryIDs runs a statement selecting ids
+func (db *DB) queryIDs(statement string, args ...interface{}) ([]int64, error) {
+	rows, err := db.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// rehashFile stores the new checksum of a created or modified file. It
+// returns false if the file changed while it was read.
+func (db *DB) rehashFile(basepath string, rel string) (bool, error) {
+	path := basepath + rel
+	before, err := os.Lstat(path)
+	if err != nil || !before.Mode().IsRegular() {
+		// gone again, or not a file checksummer collects
+		return true, nil
+	}
+
+	chunksize := db.GetChunksize()
+	var hash string
+	var chunks []string
+	if chunksize > 0 {
+		hash, chunks, err = HashFileChunks(path, chunksize)
+	} else {
+		hash, err = HashFile(path)
+	}
+	if err != nil {
+		return true, err
+	}
+	after, err := os.Lstat(path)
+	if err != nil || after.Size() != before.Size() || after.ModTime() != before.ModTime() {
+		return false, nil
+	}
+
+	// like CollectFiles, the insert fails for files already known
+	db.Exec("INSERT INTO files(filename, filesize, mtime, file_found) VALUES(?, ?, ?, 1)", rel, after.Size(), after.ModTime().Unix())
+
+	tx, err := db.Begin()
+	if err != nil {
+		return true, err
+	}
+	var id int64
+	err = tx.QueryRow("SELECT id FROM files WHERE filename = ?", rel).Scan(&id)
+	if err == nil {
+		_, err = tx.Exec(`UPDATE files
+                          SET checksum_sha256 = ?, filesize = ?, mtime = ?, file_found = 1, checksum_ok = NULL
+                          WHERE id = ?`, hash, after.Size(), after.ModTime().Unix(), id)
+	}
+	if err == nil && chunksize > 0 {
+		err = saveChunks(tx, id, chunksize, chunks)
+	} else if err == nil {
+		_, err = tx.Exec("DELETE FROM chunks WHERE file_id = ?", id)
+	}
+	if err != nil {
+		tx.Rollback()
+		return true, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return true, err
+	}
+	log.Printf("hashed %v", path)
+
+	if naming, ok := db.sidecars(); ok {
+		err = writeSidecar(path, naming, hash, after.ModTime(), time.Now())
+		if err != nil {
+			log.Printf("writing extended attributes of %v failed: %v", path, err)
+		}
+	}
+
+	// the parity no longer matches the content
+	return true, db.pruneParity(fmt.Sprintf("id = %d", id))
+}
+
+// rescanChanges collects new files and queues those whose size or mtime
+// changed since they were hashed; files no longer found are marked so.
+func (db *DB) rescanChanges(basepath string, pending map[string]time.Time) {
+	db.CollectFiles()
+
+	var lastID int64
+	var missing []string
+	now := time.Now()
+	for {
+		rows, err := db.Query(`SELECT id, filename, ifnull(filesize, -1), ifnull(mtime, 0),
+                                      checksum_sha256 IS NULL, file_found
+                               FROM files
+                               WHERE id > ?
+                               ORDER BY id
+                               LIMIT 10000`, lastID)
+		checkErr(err)
+		n := 0
+		for rows.Next() {
+			var rel string
+			var size, mtime int64
+			var unhashed, found bool
+			checkErr(rows.Scan(&lastID, &rel, &size, &mtime, &unhashed, &found))
+			n++
+
+			fi, err := os.Lstat(basepath + rel)
+			switch {
+			case err != nil:
+				if found {
+					missing = append(missing, rel)
+				}
+			case !fi.Mode().IsRegular():
+			case unhashed || !found || fi.Size() != size || fi.ModTime().Unix() != mtime:
+				pending[rel] = now
+			}
+		}
+		rows.Close()
+		if n == 0 {
+			break
+		}
+	}
+
+	for _, rel := range missing {
+		_, err := db.markMissing(rel)
+		checkErr(err)
+		log.Printf("deleted %v", basepath+rel)
+	}
+	log.Printf("rescan done, %v files to hash", len(pending))
+}
+
+// queueTree queues all files below a directory that appeared in the tree
+func queueTree(basepath string, dir string, pending map[string]time.Time, due time.Time) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			pending[strings.TrimPrefix(path, basepath)] = due
+		}
+		return nil
+	})
+}
+
+// Watch keeps the database up to date with the changes in the tree until
+// the process is stopped. Changed files are hashed once they were left
+// alone for opts.Settle. The changes are applied in batches, at most one
+// per opts.Settle, each taking the write lock only while it runs. If the
+// tree cannot be watched, it is rescanned every opts.Rescan instead.
+func (db *DB) Watch(opts WatchOptions) error {
+
+	// get basepath
+	basepath, err := db.GetOption("basepath")
+	checkErr(err)
+
+	log.SetOutput(os.Stdout)
+	var events <-chan watchEvent
+	var rescan <-chan time.Time
+	fallback := func(err error) {
+		log.Printf("%v, falling back to rescans every %v", err, opts.Rescan)
+		events = nil
+		rescan = time.NewTicker(opts.Rescan).C
+	}
+
+	w, err := newWatcher()
+	if err == nil {
+		err = w.addTree(basepath)
+	}
+	if err != nil {
+		if w != nil {
+			w.close()
+		}
+		fallback(err)
+	} else {
+		defer w.close()
+		events = w.events
+		log.Printf("watching %v directories in %v", w.count(), basepath)
+	}
+
+	pending := map[string]time.Time{}
+	moves := map[uint32]movedFrom{}
+
+	// removals and renames wait for the next batch, in order
+	var changes []pathChange
+	// the first batch catches up with the changes made while not watching
+	rescanDue := true
+	var lastBatch time.Time
+	postponed := ""
+
+	removed := func(path string) {
+		rel := strings.TrimPrefix(path, basepath)
+		for p := range pending {
+			if p == rel || strings.HasPrefix(p, rel+"/") {
+				delete(pending, p)
+			}
+		}
+		changes = append(changes, pathChange{from: rel})
+	}
+
+	// batch applies the queued changes holding the write lock, so that
+	// other commands can write in between; releasing it writes the
+	// manifest. It returns false if the database is busy.
+	batch := func(now time.Time) bool {
+		err := db.Lock("watch")
+		if err != nil {
+			if err.Error() != postponed {
+				log.Printf("%v, postponing the changes", err)
+				postponed = err.Error()
+			}
+			return false
+		}
+		defer db.Unlock()
+		postponed = ""
+
+		for _, c := range changes {
+			if c.to == "" {
+				n, err := db.markMissing(c.from)
+				checkErr(err)
+				if n > 0 {
+					log.Printf("deleted %v", basepath+c.from)
+				}
+				continue
+			}
+			known, err := db.renamePath(c.from, c.to)
+			checkErr(err)
+			log.Printf("moved %v -> %v", basepath+c.from, basepath+c.to)
+			if !known {
+				queueTree(basepath, basepath+c.to, pending, now.Add(opts.Settle))
+			}
+		}
+		changes = nil
+		if rescanDue {
+			db.rescanChanges(basepath, pending)
+			rescanDue = false
+		}
+
+		for rel, due := range pending {
+			if now.Before(due) {
+				continue
+			}
+			settled, err := db.rehashFile(basepath, rel)
+			if err != nil {
+				log.Printf("hashing %v failed: %v", basepath+rel, err)
+			}
+			if !settled {
+				pending[rel] = now.Add(opts.Settle)
+				continue
+			}
+			delete(pending, rel)
+		}
+		return true
+	}
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case e := <-events:
+			rel := strings.TrimPrefix(e.path, basepath)
+			due := time.Now().Add(opts.Settle)
+			switch e.op {
+			case watchCreate, watchWrite:
+				if !e.dir {
+					pending[rel] = due
+					break
+				}
+				if err := w.addTree(e.path); err != nil {
+					w.close()
+					fallback(err)
+				}
+				queueTree(basepath, e.path, pending, due)
+			case watchRemove:
+				removed(e.path)
+			case watchMovedFrom:
+				moves[e.cookie] = movedFrom{path: e.path, dir: e.dir, at: time.Now()}
+			case watchMovedTo:
+				from, ok := moves[e.cookie]
+				delete(moves, e.cookie)
+				if ok {
+					changes = append(changes, pathChange{from: strings.TrimPrefix(from.path, basepath), to: rel})
+					if e.dir {
+						w.rename(from.path, e.path)
+					}
+					// files of the old name waiting to be hashed
+					for p, due := range pending {
+						if old := strings.TrimPrefix(from.path, basepath); p == old || strings.HasPrefix(p, old+"/") {
+							delete(pending, p)
+							pending[rel+strings.TrimPrefix(p, old)] = due
+						}
+					}
+					break
+				}
+				if e.dir {
+					if err := w.addTree(e.path); err != nil {
+						w.close()
+						fallback(err)
+					}
+				}
+				queueTree(basepath, e.path, pending, due)
+			case watchOverflow:
+				log.Printf("too many changes at once, rescanning")
+				rescanDue = true
+			}
+
+		case <-rescan:
+			rescanDue = true
+
+		case now := <-tick.C:
+			// moved out of the tree
+			for cookie, from := range moves {
+				if now.Sub(from.at) > time.Second {
+					delete(moves, cookie)
+					if from.dir {
+						w.forget(from.path)
+					}
+					removed(from.path)
+				}
+			}
+
+			// at most one batch per settle time, so that the lock is
+			// free in between
+			if now.Sub(lastBatch) < opts.Settle {
+				break
+			}
+			due := rescanDue || len(changes) > 0
+			for _, t := range pending {
+				if !now.Before(t) {
+					due = true
+					break
+				}
+			}
+			if due && batch(now) {
+				lastBatch = now
+			}
+		}
+	}
+}
+
+func cmdWatch(db *DB, args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	settle := flags.Duration("settle", 10*time.Second, "hash changed files after they were left alone this long")
+	rescan := flags.Duration("rescan", time.Hour, "interval of the rescans if the tree cannot be watched")
+	flags.Parse(args)
+
+	return db.Watch(WatchOptions{Settle: *settle, Rescan: *rescan})
+}
@@ -0,0 +1,169 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// watchMask are the inotify events the watcher asks for
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DONT_FOLLOW | syscall.IN_EXCL_UNLINK
+
+// watcher watches a tree with one inotify watch per directory
+type watcher struct {
+	fd     int
+	file   *os.File // fd in the runtime poller, closing it stops read
+	mutex  sync.Mutex
+	dirs   map[int]string // watch descriptor to path
+	events chan watchEvent
+	done   chan struct{}
+	once   sync.Once
+}
+
+// newWatcher starts reading inotify events
+func newWatcher() (*watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &watcher{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		dirs:   map[int]string{},
+		events: make(chan watchEvent, 1024),
+		done:   make(chan struct{}),
+	}
+	go w.read()
+	return w, nil
+}
+
+// addTree watches a directory and all directories below it
+func (w *watcher) addTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+		if err == syscall.ENOSPC {
+			return errWatchLimit
+		}
+		if err != nil {
+			// vanished or unreadable, skip it
+			return nil
+		}
+		w.mutex.Lock()
+		w.dirs[wd] = path
+		w.mutex.Unlock()
+		return nil
+	})
+}
+
+// rename updates the paths of a directory moved within the tree, the
+// kernel keeps watching it
+func (w *watcher) rename(from string, to string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for wd, path := range w.dirs {
+		if path == from || strings.HasPrefix(path, from+"/") {
+			w.dirs[wd] = to + strings.TrimPrefix(path, from)
+		}
+	}
+}
+
+// forget stops watching a directory moved out of the tree
+func (w *watcher) forget(dir string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for wd, path := range w.dirs {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+}
+
+// count returns the number of watched directories
+func (w *watcher) count() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.dirs)
+}
+
+// close stops the reader, also when nobody takes its events any more
+// after falling back to rescans, and releases the inotify instance
+func (w *watcher) close() {
+	w.once.Do(func() {
+		close(w.done)
+		w.file.Close()
+	})
+}
+
+// send passes an event on unless the watcher was closed
+func (w *watcher) send(e watchEvent) bool {
+	select {
+	case w.events <- e:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// read turns inotify events into watchEvents until the watcher is closed
+func (w *watcher) read() {
+	buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buffer)
+		if err != nil || n <= 0 {
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			name := strings.TrimRight(string(buffer[offset+syscall.SizeofInotifyEvent:offset+syscall.SizeofInotifyEvent+int(raw.Len)]), "\x00")
+			offset += syscall.SizeofInotifyEvent + int(raw.Len)
+
+			if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				if !w.send(watchEvent{op: watchOverflow}) {
+					return
+				}
+				continue
+			}
+
+			w.mutex.Lock()
+			dir, ok := w.dirs[int(raw.Wd)]
+			if raw.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, int(raw.Wd))
+			}
+			w.mutex.Unlock()
+			if !ok || name == "" {
+				continue
+			}
+
+			e := watchEvent{path: filepath.Join(dir, name), dir: raw.Mask&syscall.IN_ISDIR != 0, cookie: raw.Cookie}
+			switch {
+			case raw.Mask&syscall.IN_CREATE != 0:
+				e.op = watchCreate
+			case raw.Mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MODIFY) != 0:
+				e.op = watchWrite
+			case raw.Mask&syscall.IN_DELETE != 0:
+				e.op = watchRemove
+			case raw.Mask&syscall.IN_MOVED_FROM != 0:
+				e.op = watchMovedFrom
+			case raw.Mask&syscall.IN_MOVED_TO != 0:
+				e.op = watchMovedTo
+			default:
+				continue
+			}
+			if !w.send(e) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// watcher is only implemented with Linux inotify
+type watcher struct {
+	events chan watchEvent
+}
+
+// newWatcher fails, the watch command falls back to periodic rescans
+func newWatcher() (*watcher, error) {
+	return nil, errors.New("watching is not supported on this platform")
+}
+
+func (w *watcher) addTree(dir string) error      { return nil }
+func (w *watcher) rename(from string, to string) {}
+func (w *watcher) forget(dir string)             {}
+func (w *watcher) count() int                    { return 0 }
+func (w *watcher) close()                        {}
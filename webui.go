@@ -0,0 +1,192 @@
+package main
+
+// webUI is the page served by the serve command. It only talks to the JSON API.
+const webUI = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Checksummer</title>
+<style>
+body { font-family: sans-serif; margin: 0; color: #222; }
+header { background: #333; color: #fff; padding: 0.6em 1em; }
+header span { color: #aaa; margin-left: 1em; }
+nav { padding: 0.5em 1em; border-bottom: 1px solid #ddd; }
+nav button { margin-right: 0.3em; }
+main { padding: 1em; }
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: 0.2em 0.6em; border-bottom: 1px solid #eee; font-size: 0.9em; }
+td.num, th.num { text-align: right; white-space: nowrap; }
+tr.group td { background: #f4f4f4; font-weight: bold; }
+.error { color: #b00; }
+#jobs { margin-top: 1em; }
+progress { width: 20em; }
+</style>
+</head>
+<body>
+<header>Checksummer <span id="summary"></span></header>
+<nav>
+<form id="search" style="display: inline">
+<input id="q" size="40" placeholder="holiday ext:jpg size>1M modified<2015">
+<button>search</button>
+</form>
+<button data-view="stats">stats</button>
+<button data-view="duplicates">duplicates</button>
+<button data-view="deleted">deleted</button>
+<button data-view="changed">changed</button>
+<button data-view="jobs">jobs</button>
+</nav>
+<main id="main"></main>
+<script>
+var main = document.getElementById("main");
+
+function esc(s) {
+	return String(s).replace(/[&<>"]/g, function(c) {
+		return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"}[c];
+	});
+}
+
+function size(b) {
+	var units = ["B", "KB", "MB", "GB", "TB", "PB"];
+	var i = 0;
+	while (b >= 1024 && i < units.length - 1) { b /= 1024; i++; }
+	return b.toFixed(2) + units[i];
+}
+
+function date(t) {
+	return t ? new Date(t * 1000).toISOString().replace("T", " ").substr(0, 19) : "";
+}
+
+function api(path, options) {
+	return fetch(path, options).then(function(r) {
+		return r.json().then(function(data) {
+			if (!r.ok) { throw new Error(data.error || r.statusText); }
+			return data;
+		});
+	});
+}
+
+function fail(err) {
+	main.innerHTML = '<p class="error">' + esc(err.message) + '</p>';
+}
+
+function fileRows(records) {
+	var html = '<table><tr><th class="num">size</th><th>modified</th><th>path</th></tr>';
+	records.forEach(function(r) {
+		html += '<tr><td class="num">' + size(r.size) + '</td><td>' + date(r.mtime) +
+			'</td><td><a href="#" data-history="' + esc(r.path) + '">' + esc(r.path) + '</a></td></tr>';
+	});
+	return html + '</table><p>' + records.length + ' files</p>';
+}
+
+function buckets(title, list, total) {
+	var html = '<h3>' + title + '</h3><table>';
+	list.forEach(function(b) {
+		html += '<tr><td class="num">' + b.files + ' files</td><td class="num">' + size(b.bytes) +
+			'</td><td class="num">' + (total ? (b.bytes * 100 / total).toFixed(1) : 0) + '%</td><td>' + esc(b.name || "(none)") + '</td></tr>';
+	});
+	return html + '</table>';
+}
+
+var views = {
+	stats: function() {
+		api("/api/stats").then(function(s) {
+			document.getElementById("summary").textContent = s.basepath + "  " + s.files + " files, " + size(s.bytes);
+			var pct = function(n) { return s.files ? (n * 100 / s.files).toFixed(1) + "%" : "0%"; };
+			main.innerHTML = '<table>' +
+				'<tr><td>hashed</td><td class="num">' + s.hashed + '</td><td class="num">' + pct(s.hashed) + '</td></tr>' +
+				'<tr><td>verified in the last ' + s.verified_days + ' days</td><td class="num">' + s.verified + '</td><td class="num">' + pct(s.verified) + '</td></tr>' +
+				'<tr><td>deleted</td><td class="num">' + s.deleted + '</td><td></td></tr>' +
+				'<tr><td>changed</td><td class="num">' + s.changed + '</td><td></td></tr></table>' +
+				buckets("by extension", s.extensions, s.bytes) + buckets("by modification year", s.years, s.bytes) +
+				buckets("by size", s.sizes, s.bytes) + buckets("largest directories", s.directories, s.bytes);
+		}).catch(fail);
+	},
+	duplicates: function() {
+		api("/api/duplicates").then(function(groups) {
+			var html = '<table>';
+			groups.forEach(function(g) {
+				html += '<tr class="group"><td colspan="2">' + g.files.length + ' copies of ' + size(g.size) +
+					', ' + size(g.size * (g.files.length - 1)) + ' wasted</td></tr>';
+				g.files.forEach(function(r) {
+					html += '<tr><td>' + date(r.mtime) + '</td><td>' + esc(r.path) + '</td></tr>';
+				});
+			});
+			main.innerHTML = html + '</table><p>' + groups.length + ' groups of duplicates</p>';
+		}).catch(fail);
+	},
+	deleted: function() {
+		api("/api/deleted").then(function(records) { main.innerHTML = fileRows(records); }).catch(fail);
+	},
+	changed: function() {
+		api("/api/changed").then(function(records) { main.innerHTML = fileRows(records); }).catch(fail);
+	},
+	jobs: function() {
+		main.innerHTML = '<p>Starting jobs needs the token printed by <code>checksummer serve</code>.</p>' +
+			'<input id="token" type="password" size="34" placeholder="token" value="' + esc(sessionStorage.token || "") + '"> ' +
+			'<button data-job="collect">collect files</button> <button data-job="checksums">make checksums</button> ' +
+			'<button data-job="verify">reindex &amp; check</button><div id="jobs"></div>';
+		showJobs();
+	}
+};
+
+function auth() {
+	var input = document.getElementById("token");
+	if (input) { sessionStorage.token = input.value; }
+	return {"Authorization": "Bearer " + (sessionStorage.token || "")};
+}
+
+var polling = null;
+function showJobs() {
+	clearTimeout(polling);
+	var div = document.getElementById("jobs");
+	if (!div) { return; }
+	api("/api/jobs", {headers: auth()}).then(function(list) {
+		var html = '<table><tr><th>job</th><th>state</th><th>progress</th><th>current file</th></tr>';
+		var running = false;
+		list.reverse().forEach(function(j) {
+			var p = j.progress;
+			running = running || j.state == "running";
+			html += '<tr><td>' + j.id + ' ' + esc(j.type) + '</td><td>' + esc(j.state) + ' ' + esc(j.error || "") + '</td><td>' +
+				(p.label ? esc(p.label) + ' <progress max="' + (p.total_bytes || 1) + '" value="' + p.bytes + '"></progress> ' +
+				p.files + '/' + p.total_files + ' files' : '') + '</td><td>' + esc(p.current || "") + '</td></tr>';
+		});
+		div.innerHTML = html + '</table>';
+		if (running) { polling = setTimeout(showJobs, 1000); }
+	}).catch(function(err) { div.innerHTML = '<p class="error">' + esc(err.message) + '</p>'; });
+}
+
+document.addEventListener("click", function(e) {
+	var t = e.target;
+	if (t.dataset.view) {
+		views[t.dataset.view]();
+	} else if (t.dataset.job) {
+		var body = new URLSearchParams({type: t.dataset.job});
+		api("/api/jobs", {method: "POST", headers: auth(), body: body}).then(showJobs).catch(function(err) {
+			document.getElementById("jobs").innerHTML = '<p class="error">' + esc(err.message) + '</p>';
+		});
+	} else if (t.dataset.history) {
+		e.preventDefault();
+		api("/api/history?path=" + encodeURIComponent(t.dataset.history)).then(function(history) {
+			var html = '<h3>' + esc(t.dataset.history) + '</h3><table><tr><th>snapshot</th><th class="num">size</th><th>modified</th><th>checksum</th></tr>';
+			history.forEach(function(h) {
+				html += '<tr><td>' + esc(h.snapshot || "now") + '</td><td class="num">' + size(h.size) + '</td><td>' +
+					date(h.mtime) + '</td><td>' + esc(h.checksum) + '</td></tr>';
+			});
+			main.innerHTML = html + '</table>';
+		}).catch(fail);
+	}
+});
+
+document.getElementById("search").addEventListener("submit", function(e) {
+	e.preventDefault();
+	api("/api/search?q=" + encodeURIComponent(document.getElementById("q").value)).then(function(records) {
+		main.innerHTML = fileRows(records);
+	}).catch(fail);
+});
+
+views.stats();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// xattrNaming are the names of the extended attributes a checksum is kept in
+type xattrNaming struct {
+	checksum string // hex SHA-256, the algorithm is part of the name
+	mtime    string // modification time of the file when it was hashed
+	hashed   string // when it was hashed, empty if the naming has none
+}
+
+// xattrNamings are checksummer's own names and those of shatag, which are
+// also read and written by cshatag
+var xattrNamings = map[string]xattrNaming{
+	"checksum": {"user.checksum.sha256", "user.checksum.mtime", "user.checksum.hashed"},
+	"shatag":   {"user.shatag.sha256", "user.shatag.ts", ""},
+}
+
+// defaultXattrNaming is used until another naming is chosen
+const defaultXattrNaming = "checksum"
+
+var errNoXattr = errors.New("no checksum in the extended attributes")
+
+// xattrOptions are the settings of the extended attributes, stored as
+// options prefixed with xattr_
+var xattrOptions = []struct {
+	name string
+	help string
+}{
+	{"write", "on to store the checksums in extended attributes when hashing (default off)"},
+	{"names", "checksum for user.checksum.*, or shatag for user.shatag.* as shatag and cshatag use (default checksum)"},
+}
+
+// Sidecar is a checksum kept in the extended attributes of a file
+type Sidecar struct {
+	Checksum string
+	Mtime    time.Time
+	Hashed   time.Time // zero if not recorded
+}
+
+// current tells whether the file was not modified since it was hashed.
+// shatag stores the time as a float, which is only exact to microseconds.
+func (s Sidecar) current(info os.FileInfo) bool {
+	d := s.Mtime.Sub(info.ModTime())
+	return d > -time.Microsecond && d < time.Microsecond
+}
+
+// formatXattrTime formats a time as seconds.nanoseconds like shatag
+func formatXattrTime(t time.Time) string {
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
+
+func parseXattrTime(value string) (time.Time, error) {
+	parts := strings.SplitN(strings.TrimRight(value, "\x00\n"), ".", 2)
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var nsec int64
+	if len(parts) == 2 {
+		nsec, err = strconv.ParseInt((parts[1] + "000000000")[:9], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(sec, nsec), nil
+}
+
+// readSidecar reads the checksum of a file from its extended attributes,
+// in checksummer's names or shatag's, the newer if both are there
+func readSidecar(path string) (Sidecar, error) {
+	found := Sidecar{}
+	err := errNoXattr
+	for _, name := range []string{"checksum", "shatag"} {
+		s, rerr := readSidecarNamed(path, xattrNamings[name])
+		switch {
+		case rerr == errNoXattr:
+		case err == errNoXattr, err != nil && rerr == nil, rerr == nil && s.Mtime.After(found.Mtime):
+			found, err = s, rerr
+		}
+	}
+	return found, err
+}
+
+func readSidecarNamed(path string, naming xattrNaming) (Sidecar, error) {
+	checksum, err := getXattr(path, naming.checksum)
+	if err != nil {
+		return Sidecar{}, err
+	}
+	s := Sidecar{Checksum: strings.ToLower(strings.TrimRight(checksum, "\x00\n"))}
+	if b, err := hex.DecodeString(s.Checksum); err != nil || len(b) != 32 {
+		return Sidecar{}, fmt.Errorf("%v is not a SHA-256 checksum", naming.checksum)
+	}
+	mtime, err := getXattr(path, naming.mtime)
+	if err == nil {
+		s.Mtime, err = parseXattrTime(mtime)
+	}
+	if err != nil {
+		return Sidecar{}, fmt.Errorf("%v: %v", naming.mtime, err)
+	}
+	if naming.hashed != "" {
+		if hashed, err := getXattr(path, naming.hashed); err == nil {
+			s.Hashed, _ = parseXattrTime(hashed)
+		}
+	}
+	return s, nil
+}
+
+// writeSidecar stores the checksum of a file, which had mtime when it was
+// hashed, in its extended attributes. The checksum goes first: interrupted,
+// a new checksum with an old time reads as modified, not as corrupt.
+func writeSidecar(path string, naming xattrNaming, checksum string, mtime time.Time, hashed time.Time) error {
+	err := setXattr(path, naming.checksum, checksum)
+	if err == nil {
+		err = setXattr(path, naming.mtime, formatXattrTime(mtime))
+	}
+	if err == nil && naming.hashed != "" && !hashed.IsZero() {
+		err = setXattr(path, naming.hashed, formatXattrTime(hashed))
+	}
+	return err
+}
+
+// xattrOption returns a setting of the extended attributes, empty if not set
+func (db *DB) xattrOption(name string) string {
+	return db.optionalOption("xattr_" + name)
+}
+
+// xattrNaming returns the names checksums are written to
+func (db *DB) xattrNaming() xattrNaming {
+	naming, ok := xattrNamings[db.xattrOption("names")]
+	if !ok {
+		naming = xattrNamings[defaultXattrNaming]
+	}
+	return naming
+}
+
+// sidecars returns the names checksums are written to when hashing, false
+// if they are not written
+func (db *DB) sidecars() (xattrNaming, bool) {
+	return db.xattrNaming(), db.xattrOption("write") == "on"
+}
+
+// hashedFiles returns the next block of found files after the given id
+func (db *DB) hashedFiles(after int64, hashed bool) ([]File, error) {
+	condition := "checksum_sha256 IS NOT NULL"
+	if !hashed {
+		condition = "checksum_sha256 IS NULL"
+	}
+	rows, err := db.Query(`SELECT id, filename, ifnull(filesize, 0), ifnull(mtime, 0), ifnull(checksum_sha256, '')
+                           FROM files
+                           WHERE file_found = '1' AND id > ? AND `+condition+`
+                           ORDER BY id
+                           LIMIT 10000`, after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []File
+	for rows.Next() {
+		var file File
+		err = rows.Scan(&file.ID, &file.Name, &file.Size, &file.Mtime, &file.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+// WriteSidecars stores the checksums of all hashed files in their extended
+// attributes, e.g. after turning them on. Files modified since they were
+// hashed are skipped, their checksums are outdated.
+func (db *DB) WriteSidecars() error {
+	// get basepath
+	basepath, err := db.GetOption("basepath")
+	if err != nil {
+		return err
+	}
+	naming := db.xattrNaming()
+
+	var lastID int64
+	var written, current, modified, failed int
+	for {
+		files, err := db.hashedFiles(lastID, true)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			break
+		}
+		lastID = files[len(files)-1].ID
+
+		for _, file := range files {
+			path := basepath + file.Name
+			info, err := os.Stat(path)
+			if err != nil || info.Size() != file.Size || info.ModTime().Unix() != file.Mtime {
+				modified++
+				continue
+			}
+			s, err := readSidecarNamed(path, naming)
+			if err == nil && s.Checksum == file.Checksum && s.current(info) {
+				current++
+				continue
+			}
+			err = writeSidecar(path, naming, file.Checksum, info.ModTime(), time.Time{})
+			if err != nil {
+				fmt.Println("write error:", path, err)
+				failed++
+				continue
+			}
+			written++
+		}
+	}
+
+	fmt.Printf("%v written, %v already current, %v modified since hashed, %v failed\n",
+		thousandsSeparator(written), thousandsSeparator(current), thousandsSeparator(modified), thousandsSeparator(failed))
+	if failed > 0 {
+		return fmt.Errorf("writing extended attributes failed for %v files", failed)
+	}
+	return nil
+}
+
+// ImportSidecars fills in missing checksums from the extended attributes of
+// the files, which rebuilds a database without reading all files again.
+// Only checksums of files not modified since they were hashed are taken.
+func (db *DB) ImportSidecars() error {
+	// get basepath
+	basepath, err := db.GetOption("basepath")
+	if err != nil {
+		return err
+	}
+
+	var lastID int64
+	var imported, modified, missing int
+	for {
+		files, err := db.hashedFiles(lastID, false)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			break
+		}
+		lastID = files[len(files)-1].ID
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			path := basepath + file.Name
+			info, err := os.Stat(path)
+			if err != nil {
+				missing++
+				continue
+			}
+			s, err := readSidecar(path)
+			if err != nil {
+				if err != errNoXattr {
+					fmt.Println("read error:", path, err)
+				}
+				missing++
+				continue
+			}
+			if !s.current(info) {
+				modified++
+				continue
+			}
+			_, err = tx.Exec("UPDATE files SET checksum_sha256 = ? WHERE id = ?", s.Checksum, file.ID)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			imported++
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("%v checksums imported, %v modified since hashed, %v without checksum\n",
+		thousandsSeparator(imported), thousandsSeparator(modified), thousandsSeparator(missing))
+	return nil
+}
+
+// CheckSidecars compares the checksums in the database with those in the
+// extended attributes, without reading the files. If they differ for a file
+// not modified since, one of them is wrong.
+func (db *DB) CheckSidecars() error {
+	// get basepath
+	basepath, err := db.GetOption("basepath")
+	if err != nil {
+		return err
+	}
+
+	var lastID int64
+	var matching, differing, modified, missing int
+	for {
+		files, err := db.hashedFiles(lastID, true)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			break
+		}
+		lastID = files[len(files)-1].ID
+
+		for _, file := range files {
+			path := basepath + file.Name
+			s, err := readSidecar(path)
+			if err != nil {
+				if err != errNoXattr {
+					fmt.Println("read error:", path, err)
+				}
+				missing++
+				continue
+			}
+			info, err := os.Stat(path)
+			switch {
+			case err != nil:
+				missing++
+			case !s.current(info):
+				modified++
+			case s.Checksum != file.Checksum:
+				fmt.Println("differs:", path)
+				differing++
+			default:
+				matching++
+			}
+		}
+	}
+
+	fmt.Printf("%v match, %v differ, %v modified since hashed, %v without checksum\n",
+		thousandsSeparator(matching), thousandsSeparator(differing), thousandsSeparator(modified), thousandsSeparator(missing))
+	if differing > 0 {
+		return fmt.Errorf("%v checksums differ from the database, check these files", differing)
+	}
+	return nil
+}
+
+// VerifySidecars checks files against the checksums in their extended
+// attributes, without a database, e.g. copies of files taken elsewhere
+func VerifySidecars(paths []string) error {
+	var files []string
+	var sizes []int64
+	var totalSize int64
+	for _, root := range paths {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				files = append(files, path)
+				sizes = append(sizes, info.Size())
+				totalSize += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	progress := NewProgress("verifying", len(files), totalSize)
+	var ok, corrupt, modified, missing, failed int
+	for i, path := range files {
+		progress.StartFile(path)
+		s, err := readSidecar(path)
+		var info os.FileInfo
+		if err == nil {
+			info, err = os.Stat(path)
+		}
+		switch {
+		case err == errNoXattr:
+			missing++
+		case err != nil:
+			progress.Println("read error:", path, err)
+			failed++
+		case !s.current(info):
+			progress.Println("modified since hashed:", path)
+			modified++
+		default:
+			hash, err := hashFile(path, progress)
+			switch {
+			case err != nil:
+				progress.Println("read error:", path, err)
+				failed++
+			case hash != s.Checksum:
+				progress.Println("corrupt:", path)
+				corrupt++
+			default:
+				ok++
+			}
+		}
+		progress.FinishFile(sizes[i])
+	}
+	progress.Finish()
+
+	fmt.Printf("%v ok, %v corrupt, %v modified since hashed, %v without checksum, %v unreadable\n",
+		thousandsSeparator(ok), thousandsSeparator(corrupt), thousandsSeparator(modified),
+		thousandsSeparator(missing), thousandsSeparator(failed))
+	if corrupt+failed > 0 {
+		return fmt.Errorf("%v files corrupt, %v unreadable", corrupt, failed)
+	}
+	return nil
+}
+
+func cmdXattr(db *DB, args []string) error {
+	var action string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("xattr", flag.ExitOnError)
+	list := flags.Bool("list", false, "show the settings of the extended attributes")
+	set := flags.String("set", "", "change a setting, e.g. write=on")
+	flags.Parse(args)
+
+	switch {
+	case *list:
+		for _, o := range xattrOptions {
+			fmt.Printf("%-8v %-10v %v\n", o.name, db.xattrOption(o.name), o.help)
+		}
+		return nil
+	case *set != "":
+		parts := strings.SplitN(*set, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("use -set NAME=VALUE")
+		}
+		switch parts[0] {
+		case "write":
+			if parts[1] != "on" && parts[1] != "off" {
+				return fmt.Errorf("write is on or off")
+			}
+		case "names":
+			if _, ok := xattrNamings[parts[1]]; !ok {
+				return fmt.Errorf("names is checksum or shatag")
+			}
+		default:
+			return fmt.Errorf("unknown setting %q, see xattr -list", parts[0])
+		}
+		return db.SetOption("xattr_"+parts[0], parts[1])
+	}
+
+	switch action {
+	case "write":
+		return db.WriteSidecars()
+	case "import":
+		return db.withLock("xattr import", db.ImportSidecars)
+	case "check":
+		return db.CheckSidecars()
+	case "verify":
+		paths := flags.Args()
+		if len(paths) == 0 {
+			// get basepath
+			basepath, err := db.GetOption("basepath")
+			if err != nil {
+				return err
+			}
+			paths = []string{basepath}
+		}
+		return VerifySidecars(paths)
+	}
+	return fmt.Errorf("use xattr write, xattr import, xattr check, xattr verify [PATH...], xattr -list or xattr -set NAME=VALUE")
+}
@@ -0,0 +1,33 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "syscall"
+
+// getXattr reads an extended attribute, errNoXattr if the file has none
+func getXattr(path string, name string) (string, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	for err == nil {
+		value := make([]byte, size)
+		var n int
+		n, err = syscall.Getxattr(path, name, value)
+		if err == syscall.ERANGE {
+			// grew in between
+			size, err = syscall.Getxattr(path, name, nil)
+			continue
+		}
+		if err == nil {
+			return string(value[:n]), nil
+		}
+	}
+	if err == syscall.ENODATA {
+		return "", errNoXattr
+	}
+	return "", err
+}
+
+// setXattr writes an extended attribute, replacing an existing one
+func setXattr(path string, name string, value string) error {
+	return syscall.Setxattr(path, name, []byte(value), 0)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+var errXattrUnsupported = errors.New("extended attributes are not supported on this platform")
+
+// getXattr reads an extended attribute, only supported on Linux
+func getXattr(path string, name string) (string, error) {
+	return "", errXattrUnsupported
+}
+
+// setXattr writes an extended attribute, only supported on Linux
+func setXattr(path string, name string, value string) error {
+	return errXattrUnsupported
+}